@@ -0,0 +1,94 @@
+package actions
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// Check checks that the assignments refer to resources of the memory and
+// that their values have the type of the resources: the integers can be
+// assigned to the float resources, and the texts in RFC 3339 format to
+// the time resources
+func Check(assignments []Assignment, memory schema.MemoryResources) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	for _, a := range assignments {
+		// I look for the type of the resource...
+		resourceType, ok := typeOf(a.Resource, memory)
+		if !ok {
+			diagnostics = append(diagnostics, Diagnostic{
+				Position: a.Pos,
+				Message:  fmt.Sprintf("unknown resource \"%s\"", a.Resource),
+			})
+			continue
+		}
+		// ... and I check the value against it
+		if assignable(a.Value, resourceType) {
+			continue
+		}
+		message := fmt.Sprintf("resource \"%s\" has type %s, found a literal of type %s", a.Resource, resourceType, a.Value.Type)
+		if resourceType == "time" && a.Value.Type == LiteralText {
+			message = fmt.Sprintf("resource \"%s\" has type time, expected a text in RFC 3339 format", a.Resource)
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Position: a.Value.Pos,
+			Message:  message,
+		})
+	}
+	return diagnostics
+}
+
+// Lint parses the actions and checks them against the memory, returning
+// all the diagnostics in order of position
+func Lint(src string, memory schema.MemoryResources) ([]Assignment, []Diagnostic) {
+	assignments, diagnostics := Parse(src)
+	diagnostics = append(diagnostics, Check(assignments, memory)...)
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		a, b := diagnostics[i].Position, diagnostics[j].Position
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return assignments, diagnostics
+}
+
+// typeOf returns the type of a resource of the memory, as in MemoryResources
+func typeOf(resource string, memory schema.MemoryResources) (string, bool) {
+	if _, ok := memory.Bool[resource]; ok {
+		return "bool", true
+	}
+	if _, ok := memory.Integer[resource]; ok {
+		return "integer", true
+	}
+	if _, ok := memory.Float[resource]; ok {
+		return "float", true
+	}
+	if _, ok := memory.Text[resource]; ok {
+		return "text", true
+	}
+	if _, ok := memory.Time[resource]; ok {
+		return "time", true
+	}
+	return "", false
+}
+
+// assignable checks whether a literal can be assigned to a resource type
+func assignable(l Literal, resourceType string) bool {
+	switch resourceType {
+	case "bool":
+		return l.Type == LiteralBool
+	case "integer":
+		return l.Type == LiteralInteger
+	case "float":
+		return l.Type == LiteralFloat || l.Type == LiteralInteger
+	case "text":
+		return l.Type == LiteralText
+	case "time":
+		if l.Type != LiteralText {
+			return false
+		}
+		_, err := time.Parse(time.RFC3339Nano, l.Value.(string))
+		return err == nil
+	}
+	return false
+}
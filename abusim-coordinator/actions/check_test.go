@@ -0,0 +1,94 @@
+package actions
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// testMemory returns a memory with a resource of every type
+func testMemory() schema.MemoryResources {
+	return schema.MemoryResources{
+		Bool:    map[string]bool{"on": false},
+		Integer: map[string]int64{"temperature": 20},
+		Float:   map[string]float64{"humidity": 0.5},
+		Text:    map[string]string{"label": ""},
+		Time:    map[string]time.Time{"since": time.Now()},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		src     string
+		message string
+	}{
+		{"on = true", ""},
+		{"temperature = -3", ""},
+		{"humidity = 0.7", ""},
+		{"humidity = 1", ""},
+		{"label = \"hello\"", ""},
+		{"since = \"2026-10-17T09:30:00Z\"", ""},
+		{"since = \"2026-10-17T09:30:00.123+02:00\"", ""},
+		{"missing = 1", "unknown resource \"missing\""},
+		{"on = 1", "resource \"on\" has type bool, found a literal of type integer"},
+		{"temperature = 1.5", "resource \"temperature\" has type integer, found a literal of type float"},
+		{"humidity = \"high\"", "resource \"humidity\" has type float, found a literal of type text"},
+		{"label = false", "resource \"label\" has type text, found a literal of type bool"},
+		{"since = 5", "resource \"since\" has type time, found a literal of type integer"},
+		{"since = \"yesterday\"", "resource \"since\" has type time, expected a text in RFC 3339 format"},
+	}
+	for _, test := range tests {
+		assignments, diagnostics := Parse(test.src)
+		if len(diagnostics) != 0 {
+			t.Fatalf("%q: unexpected parse diagnostics %v", test.src, diagnostics)
+		}
+		diagnostics = Check(assignments, testMemory())
+		if test.message == "" {
+			if len(diagnostics) != 0 {
+				t.Errorf("%q: unexpected diagnostics %v", test.src, diagnostics)
+			}
+			continue
+		}
+		if len(diagnostics) != 1 || diagnostics[0].Message != test.message {
+			t.Errorf("%q: expected %q, got %v", test.src, test.message, diagnostics)
+		}
+	}
+}
+
+func TestCheckPositions(t *testing.T) {
+	// The unknown resources are reported at the resource, the wrong values
+	// at the value
+	assignments, _ := Parse("missing = 1; on = 1")
+	diagnostics := Check(assignments, testMemory())
+	expected := []Position{{1, 1}, {1, 19}}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("expected %d diagnostics, got %v", len(expected), diagnostics)
+	}
+	for i, d := range diagnostics {
+		if d.Position != expected[i] {
+			t.Errorf("expected diagnostic %d at %v, got %v", i, expected[i], d.Position)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	// The diagnostics of the parsing and of the check are sorted by position
+	assignments, diagnostics := Lint("on = 1\nx = \ntemperature = 5; missing = true", testMemory())
+	if len(assignments) != 3 {
+		t.Fatalf("expected the valid assignments, got %+v", assignments)
+	}
+	expected := []string{
+		"1:6: resource \"on\" has type bool, found a literal of type integer",
+		"2:5: expected a bool, integer, float or text literal, found new line",
+		"3:18: unknown resource \"missing\"",
+	}
+	got := []string{}
+	for _, d := range diagnostics {
+		got = append(got, d.String())
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,213 @@
+package actions
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tokenType represents a type of token of the actions
+type tokenType int
+
+const (
+	tokenEOF        tokenType = iota
+	tokenNewline    tokenType = iota
+	tokenSemicolon  tokenType = iota
+	tokenAssign     tokenType = iota
+	tokenIdentifier tokenType = iota
+	tokenNumber     tokenType = iota
+	tokenText       tokenType = iota
+	tokenIllegal    tokenType = iota
+)
+
+// token represents a token of the actions, with its position
+type token struct {
+	typ  tokenType
+	text string
+	pos  Position
+	// err describes why an illegal token is not valid
+	err string
+}
+
+// String returns the description of the token used in the diagnostics
+func (t token) String() string {
+	switch t.typ {
+	case tokenEOF:
+		return "end of input"
+	case tokenNewline:
+		return "new line"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lexer splits the actions into tokens
+type lexer struct {
+	src string
+	off int
+	pos Position
+}
+
+// tokenize returns the tokens of the actions, ending with tokenEOF
+func tokenize(src string) []token {
+	l := &lexer{
+		src: src,
+		pos: Position{Line: 1, Column: 1},
+	}
+	tokens := []token{}
+	for {
+		t := l.next()
+		tokens = append(tokens, t)
+		if t.typ == tokenEOF {
+			return tokens
+		}
+	}
+}
+
+// peek returns the next rune without consuming it, or -1 at the end
+func (l *lexer) peek() rune {
+	if l.off >= len(l.src) {
+		return -1
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.off:])
+	return r
+}
+
+// advance consumes the next rune, updating the position
+func (l *lexer) advance() rune {
+	r, size := utf8.DecodeRuneInString(l.src[l.off:])
+	l.off += size
+	if r == '\n' {
+		l.pos.Line++
+		l.pos.Column = 1
+	} else {
+		l.pos.Column++
+	}
+	return r
+}
+
+// next reads the next token
+func (l *lexer) next() token {
+	// I skip the blanks...
+	for r := l.peek(); r != '\n' && r != -1 && unicode.IsSpace(r); r = l.peek() {
+		l.advance()
+	}
+	// ... and I read the token based on its first rune
+	start := l.off
+	t := token{pos: l.pos}
+	r := l.peek()
+	switch {
+	case r == -1:
+		t.typ = tokenEOF
+		return t
+	case r == '\n':
+		l.advance()
+		t.typ = tokenNewline
+	case r == ';':
+		l.advance()
+		t.typ = tokenSemicolon
+	case r == '=':
+		l.advance()
+		t.typ = tokenAssign
+	case r == '"':
+		l.text(&t)
+	case r == '-' || r == '+' || isDigit(r):
+		l.number(&t)
+	case r == '_' || unicode.IsLetter(r):
+		for r := l.peek(); r == '_' || unicode.IsLetter(r) || isDigit(r); r = l.peek() {
+			l.advance()
+		}
+		t.typ = tokenIdentifier
+	default:
+		l.advance()
+		t.typ = tokenIllegal
+		t.err = fmt.Sprintf("unexpected character %q", r)
+	}
+	t.text = l.src[start:l.off]
+	return t
+}
+
+// text reads a double quoted text, which cannot span several lines
+func (l *lexer) text(t *token) {
+	l.advance()
+	for {
+		switch l.peek() {
+		case -1, '\n':
+			t.typ = tokenIllegal
+			t.err = "unterminated text"
+			return
+		case '\\':
+			l.advance()
+			if r := l.peek(); r != -1 && r != '\n' {
+				l.advance()
+			}
+		case '"':
+			l.advance()
+			t.typ = tokenText
+			return
+		default:
+			l.advance()
+		}
+	}
+}
+
+// number reads an integer or a float, with an optional sign, fractional
+// part and exponent
+func (l *lexer) number(t *token) {
+	t.typ = tokenNumber
+	if r := l.peek(); r == '-' || r == '+' {
+		l.advance()
+	}
+	if !l.digits() {
+		t.typ = tokenIllegal
+		t.err = "expected a digit after the sign"
+		return
+	}
+	if l.peek() == '.' {
+		l.advance()
+		if !l.digits() {
+			t.typ = tokenIllegal
+			t.err = "expected a digit after the decimal point"
+			return
+		}
+	}
+	if r := l.peek(); r == 'e' || r == 'E' {
+		l.advance()
+		if r := l.peek(); r == '-' || r == '+' {
+			l.advance()
+		}
+		if !l.digits() {
+			t.typ = tokenIllegal
+			t.err = "expected a digit in the exponent"
+			return
+		}
+	}
+	// A number cannot be followed by a name, as in 5kg
+	if r := l.peek(); r == '_' || unicode.IsLetter(r) {
+		for r := l.peek(); r == '_' || unicode.IsLetter(r) || isDigit(r); r = l.peek() {
+			l.advance()
+		}
+		t.typ = tokenIllegal
+		t.err = "invalid number"
+	}
+}
+
+// digits reads a sequence of digits, returning whether there was any
+func (l *lexer) digits() bool {
+	found := false
+	for isDigit(l.peek()) {
+		l.advance()
+		found = true
+	}
+	return found
+}
+
+// isDigit checks whether a rune is a decimal digit
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// isFloat checks whether a number token is a float
+func isFloat(text string) bool {
+	return strings.ContainsAny(text, ".eE")
+}
@@ -0,0 +1,220 @@
+// Package actions parses and checks the AbU actions sent as inputs to the
+// agents: assignments of literals to resources, such as temperature = 5,
+// separated by semicolons or new lines
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Position represents a position in the actions, starting from line 1 and
+// column 1, with the columns counted in characters
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Diagnostic represents a problem found in the actions
+type Diagnostic struct {
+	Position
+	Message string `json:"message"`
+}
+
+// String returns the description of the diagnostic, prefixed by its position
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s", d.Line, d.Column, d.Message)
+}
+
+// LiteralType represents the type of a literal
+type LiteralType int
+
+const (
+	LiteralBool    LiteralType = iota
+	LiteralInteger LiteralType = iota
+	LiteralFloat   LiteralType = iota
+	LiteralText    LiteralType = iota
+)
+
+// String returns the name of the literal type
+func (t LiteralType) String() string {
+	switch t {
+	case LiteralBool:
+		return "bool"
+	case LiteralInteger:
+		return "integer"
+	case LiteralFloat:
+		return "float"
+	case LiteralText:
+		return "text"
+	}
+	return fmt.Sprintf("unknown literal type %d", int(t))
+}
+
+// Literal represents a literal value, whose Value is a bool, an int64, a
+// float64 or a string based on the Type
+type Literal struct {
+	Type  LiteralType
+	Value interface{}
+	Pos   Position
+}
+
+// Assignment represents the assignment of a literal to a resource
+type Assignment struct {
+	Resource string
+	Pos      Position
+	Value    Literal
+}
+
+// parser builds the assignments from the tokens
+type parser struct {
+	tokens      []token
+	current     int
+	diagnostics []Diagnostic
+}
+
+// Parse parses the actions, returning the assignments that are valid and
+// the diagnostics of the invalid ones; the parsing goes on after an invalid
+// assignment, so that all the problems are reported at once
+func Parse(src string) ([]Assignment, []Diagnostic) {
+	p := &parser{
+		tokens: tokenize(src),
+	}
+	assignments := []Assignment{}
+	for {
+		// I skip the empty assignments...
+		for p.peek().typ == tokenNewline || p.peek().typ == tokenSemicolon {
+			p.advance()
+		}
+		if p.peek().typ == tokenEOF {
+			return assignments, p.diagnostics
+		}
+		// ... and I parse the next one, skipping the rest of it if invalid
+		a, ok := p.assignment()
+		if !ok {
+			p.recover()
+			continue
+		}
+		assignments = append(assignments, a)
+	}
+}
+
+// peek returns the current token
+func (p *parser) peek() token {
+	return p.tokens[p.current]
+}
+
+// advance consumes the current token, never going past the end
+func (p *parser) advance() token {
+	t := p.tokens[p.current]
+	if t.typ != tokenEOF {
+		p.current++
+	}
+	return t
+}
+
+// report adds a diagnostic for a token, using its own error if illegal
+func (p *parser) report(t token, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if t.typ == tokenIllegal {
+		message = t.err
+	}
+	p.diagnostics = append(p.diagnostics, Diagnostic{
+		Position: t.pos,
+		Message:  message,
+	})
+}
+
+// recover skips the tokens up to the end of the current assignment
+func (p *parser) recover() {
+	for {
+		switch p.peek().typ {
+		case tokenEOF, tokenNewline, tokenSemicolon:
+			return
+		}
+		p.advance()
+	}
+}
+
+// assignment parses an assignment, reporting whether it is valid
+func (p *parser) assignment() (Assignment, bool) {
+	// I read the resource...
+	a := Assignment{}
+	t := p.advance()
+	if t.typ != tokenIdentifier || t.text == "true" || t.text == "false" {
+		p.report(t, "expected a resource name, found %s", t)
+		return a, false
+	}
+	a.Resource = t.text
+	a.Pos = t.pos
+	// ... the assignment operator...
+	if t := p.peek(); t.typ != tokenAssign {
+		p.report(t, "expected '=' after \"%s\", found %s", a.Resource, t)
+		return a, false
+	}
+	p.advance()
+	// ... the value...
+	value, ok := p.literal()
+	if !ok {
+		return a, false
+	}
+	a.Value = value
+	// ... and the end of the assignment
+	switch t := p.peek(); t.typ {
+	case tokenEOF, tokenNewline, tokenSemicolon:
+		return a, true
+	default:
+		p.report(t, "expected ';' or a new line after the value of \"%s\", found %s", a.Resource, t)
+		return a, false
+	}
+}
+
+// literal parses a literal, reporting whether it is valid; the end of the
+// assignment is not consumed, so that the next one can be parsed
+func (p *parser) literal() (Literal, bool) {
+	t := p.peek()
+	if t.typ != tokenEOF && t.typ != tokenNewline && t.typ != tokenSemicolon {
+		p.advance()
+	}
+	l := Literal{
+		Pos: t.pos,
+	}
+	switch {
+	case t.typ == tokenIdentifier && (t.text == "true" || t.text == "false"):
+		l.Type = LiteralBool
+		l.Value = t.text == "true"
+	case t.typ == tokenNumber && isFloat(t.text):
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			p.report(t, "float %s out of range", t.text)
+			return l, false
+		}
+		l.Type = LiteralFloat
+		l.Value = f
+	case t.typ == tokenNumber:
+		i, err := strconv.ParseInt(t.text, 10, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			p.report(t, "integer %s out of the 64 bits range", t.text)
+			return l, false
+		}
+		if err != nil {
+			p.report(t, "invalid integer %s", t.text)
+			return l, false
+		}
+		l.Type = LiteralInteger
+		l.Value = i
+	case t.typ == tokenText:
+		s, err := strconv.Unquote(t.text)
+		if err != nil {
+			p.report(t, "invalid escape sequence in %s", t.text)
+			return l, false
+		}
+		l.Type = LiteralText
+		l.Value = s
+	default:
+		p.report(t, "expected a bool, integer, float or text literal, found %s", t)
+		return l, false
+	}
+	return l, true
+}
@@ -0,0 +1,80 @@
+package actions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected []Assignment
+	}{
+		{"", []Assignment{}},
+		{" ;\n; ", []Assignment{}},
+		{"on = true", []Assignment{
+			{"on", Position{1, 1}, Literal{LiteralBool, true, Position{1, 6}}},
+		}},
+		{"temperature = -5; humidity = 0.5", []Assignment{
+			{"temperature", Position{1, 1}, Literal{LiteralInteger, int64(-5), Position{1, 15}}},
+			{"humidity", Position{1, 19}, Literal{LiteralFloat, 0.5, Position{1, 30}}},
+		}},
+		{"ratio = +1e3\nlabel = \"say \\\"hi\\\"\"", []Assignment{
+			{"ratio", Position{1, 1}, Literal{LiteralFloat, 1e3, Position{1, 9}}},
+			{"label", Position{2, 1}, Literal{LiteralText, "say \"hi\"", Position{2, 9}}},
+		}},
+		{"città = \"è\"; _x1 = false", []Assignment{
+			{"città", Position{1, 1}, Literal{LiteralText, "è", Position{1, 9}}},
+			{"_x1", Position{1, 14}, Literal{LiteralBool, false, Position{1, 20}}},
+		}},
+	}
+	for _, test := range tests {
+		assignments, diagnostics := Parse(test.src)
+		if len(diagnostics) != 0 {
+			t.Errorf("%q: unexpected diagnostics %v", test.src, diagnostics)
+			continue
+		}
+		if !reflect.DeepEqual(assignments, test.expected) {
+			t.Errorf("%q: expected %+v, got %+v", test.src, test.expected, assignments)
+		}
+	}
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected []Diagnostic
+	}{
+		{"= 5", []Diagnostic{{Position{1, 1}, "expected a resource name, found \"=\""}}},
+		{"true = 5", []Diagnostic{{Position{1, 1}, "expected a resource name, found \"true\""}}},
+		{"x 5", []Diagnostic{{Position{1, 3}, "expected '=' after \"x\", found \"5\""}}},
+		{"x =", []Diagnostic{{Position{1, 4}, "expected a bool, integer, float or text literal, found end of input"}}},
+		{"x = y", []Diagnostic{{Position{1, 5}, "expected a bool, integer, float or text literal, found \"y\""}}},
+		{"x = 5 6", []Diagnostic{{Position{1, 7}, "expected ';' or a new line after the value of \"x\", found \"6\""}}},
+		{"x = 5kg", []Diagnostic{{Position{1, 5}, "invalid number"}}},
+		{"x = -", []Diagnostic{{Position{1, 5}, "expected a digit after the sign"}}},
+		{"x = 1.", []Diagnostic{{Position{1, 5}, "expected a digit after the decimal point"}}},
+		{"x = 1e", []Diagnostic{{Position{1, 5}, "expected a digit in the exponent"}}},
+		{"x = 99999999999999999999", []Diagnostic{{Position{1, 5}, "integer 99999999999999999999 out of the 64 bits range"}}},
+		{"x = 1e999", []Diagnostic{{Position{1, 5}, "float 1e999 out of range"}}},
+		{"x = \"abc", []Diagnostic{{Position{1, 5}, "unterminated text"}}},
+		{"x = \"\\q\"", []Diagnostic{{Position{1, 5}, "invalid escape sequence in \"\\q\""}}},
+		{"x = @", []Diagnostic{{Position{1, 5}, "unexpected character '@'"}}},
+		// The parsing goes on after an invalid assignment, from the next one
+		{"x = ; y = 1\nz 2", []Diagnostic{
+			{Position{1, 5}, "expected a bool, integer, float or text literal, found \";\""},
+			{Position{2, 3}, "expected '=' after \"z\", found \"2\""},
+		}},
+	}
+	for _, test := range tests {
+		_, diagnostics := Parse(test.src)
+		if !reflect.DeepEqual(diagnostics, test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.src, test.expected, diagnostics)
+		}
+	}
+	// The valid assignments are returned anyway
+	assignments, _ := Parse("x = ; y = 1")
+	if len(assignments) != 1 || assignments[0].Resource != "y" {
+		t.Errorf("expected the valid assignment, got %+v", assignments)
+	}
+}
@@ -1,12 +1,14 @@
 package api
 
 import (
-	"errors"
-	"log"
+	"context"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/abu-lang/abusim-core/abusim-coordinator/actions"
+	"github.com/abu-lang/abusim-core/abusim-coordinator/endpoint"
+
 	"github.com/abu-lang/abusim-core/schema"
 )
 
@@ -20,92 +22,85 @@ const (
 	ActionDebugInfo ActionType = iota
 	ActionDebugSet  ActionType = iota
 	ActionDebugStep ActionType = iota
+	ActionResource  ActionType = iota
 )
 
-// Action represents an action that the API performs
+// Action represents an action that the API performs on an agent, with a
+// memory of the agent observed by the coordinator, if known, whose resources
+// and types are the current ones even if the values are not
 type Action struct {
-	Type    ActionType
-	Payload interface{}
+	Type      ActionType
+	AgentName string
+	Payload   interface{}
+	Memory    *schema.MemoryResources
+	Context   context.Context
+	Response  chan ActionResponse
 }
 
-// ActionResponse represents a response to an Action
+// ActionResponse represents a response to an Action, either an Error or a Payload
 type ActionResponse struct {
-	Error      bool
+	Error      *Error
 	StatusCode int
 	Payload    interface{}
 }
 
-// Process waits for an Action, performs it and publish an ActionResponse
-func Process(actions chan Action, responses chan ActionResponse, ends map[string]*schema.Endpoint) {
-	// Forever...
-	for {
-		// ... I get an Action...
-		action := <-actions
-		// ... I execute the correct procedure based on its type and I publish the response
-		switch action.Type {
-		case ActionConfig:
-			responses <- doConfigGet(action, ends)
-		case ActionMemory:
-			responses <- doMemoryGet(action, ends)
-		case ActionInput:
-			responses <- doInput(action, ends)
-		case ActionDebugInfo:
-			responses <- doDebugGet(action, ends)
-		case ActionDebugSet:
-			responses <- doDebugSet(action, ends)
-		case ActionDebugStep:
-			responses <- doDebugStep(action, ends)
-		}
-	}
+// Process performs an Action on an agent and returns its ActionResponse
+func Process(action Action, agent *endpoint.Agent) ActionResponse {
+	// I execute the correct procedure based on the action type
+	switch action.Type {
+	case ActionConfig:
+		return doConfigGet(action, agent)
+	case ActionMemory:
+		return doMemoryGet(action, agent)
+	case ActionInput:
+		return doInput(action, agent)
+	case ActionDebugInfo:
+		return doDebugGet(action, agent)
+	case ActionDebugSet:
+		return doDebugSet(action, agent)
+	case ActionDebugStep:
+		return doDebugStep(action, agent)
+	case ActionResource:
+		return doResourceGet(action, agent)
+	}
+	return errorResponse(NewError(ErrorCodeInternal, action.AgentName, "unknown action type %d", action.Type))
 }
 
-func doConfigGet(action Action, ends map[string]*schema.Endpoint) ActionResponse {
-	// I get the agent name...
-	agentName := action.Payload.(string)
-	// ... I send a configuration request...
-	err := sendMessageByName(agentName, ends, &schema.EndpointMessage{
+func doConfigGet(action Action, agent *endpoint.Agent) ActionResponse {
+	// I send a configuration request, waiting for the answer
+	msg, err := sendRequest(action.Context, agent, &schema.EndpointMessage{
 		Type:    schema.EndpointMessageTypeConfigREQ,
 		Payload: nil,
 	})
 	if err != nil {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
-	}
-	// ... and I receive the answer
-	msg, err := receiveMessageByName(agentName, ends)
-	if err != nil {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
-	}
-	if msg.Type != schema.EndpointMessageTypeConfigRES {
-		err := errors.New("unexpected response")
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
+		return requestError(action, err)
 	}
 	// I get the agent configuration from the answer...
-	agent := msg.Payload.(*schema.EndpointMessagePayloadConfigRES).Agent
+	payload, ok := msg.Payload.(*schema.EndpointMessagePayloadConfigRES)
+	if msg.Type != schema.EndpointMessageTypeConfigRES || !ok {
+		return unexpectedResponse(action)
+	}
+	config := payload.Agent
 	// ... I prepare the memory item strings...
 	memory := []string{}
-	for vartype, value := range agent.Memory {
+	for vartype, value := range config.Memory {
 		for name, initvalue := range value {
 			memory = append(memory, strings.Join([]string{vartype, name, initvalue}, ":"))
 		}
 	}
+	// ... I prepare the negotiated protocol...
+	type protocol struct {
+		Version      int      `json:"version"`
+		Capabilities []string `json:"capabilities"`
+		Codec        string   `json:"codec"`
+	}
+	proto := protocol{
+		Version:      agent.Version,
+		Capabilities: agent.Capabilities,
+		Codec:        agent.Codec,
+	}
 	// ... and I respond with the configuration
 	return ActionResponse{
-		Error:      false,
 		StatusCode: http.StatusOK,
 		Payload: struct {
 			Name             string   `json:"name"`
@@ -114,54 +109,29 @@ func doConfigGet(action Action, ends map[string]*schema.Endpoint) ActionResponse
 			Rules            []string `json:"rules"`
 			Endpoints        []string `json:"endpoints"`
 			Tick             string   `json:"tick"`
+			Protocol         protocol `json:"protocol"`
 		}{
-			Name:             agent.Name,
-			MemoryController: agent.MemoryController,
+			Name:             config.Name,
+			MemoryController: config.MemoryController,
 			Memory:           memory,
-			Rules:            agent.Rules,
-			Endpoints:        agent.Endpoints,
-			Tick:             agent.Tick.String(),
+			Rules:            config.Rules,
+			Endpoints:        config.Endpoints,
+			Tick:             config.Tick.String(),
+			Protocol:         proto,
 		},
 	}
 }
 
-func doMemoryGet(action Action, ends map[string]*schema.Endpoint) ActionResponse {
-	// I get the agent name...
-	agentName := action.Payload.(string)
-	// ... I send a memory request...
-	err := sendMessageByName(agentName, ends, &schema.EndpointMessage{
-		Type:    schema.EndpointMessageTypeMemoryREQ,
-		Payload: nil,
-	})
-	if err != nil {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
-	}
-	// ... and I receive the answer
-	msg, err := receiveMessageByName(agentName, ends)
+func doMemoryGet(action Action, agent *endpoint.Agent) ActionResponse {
+	// I request the state...
+	state, err := requestMemory(action.Context, agent)
 	if err != nil {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
+		return requestError(action, err)
 	}
-	if msg.Type != schema.EndpointMessageTypeMemoryRES {
-		err := errors.New("unexpected response")
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
+	// ... I select the resources, if requested...
+	if filter, ok := action.Payload.(resourceFilter); ok {
+		state.Memory = filter.applyMemory(state.Memory)
 	}
-	// I get the state from the answer...
-	state := msg.Payload.(*schema.EndpointMessagePayloadMemoryRES)
 	// ... I prepare the memory...
 	type mem struct {
 		Bool    map[string]bool      `json:"bool"`
@@ -192,171 +162,174 @@ func doMemoryGet(action Action, ends map[string]*schema.Endpoint) ActionResponse
 	}
 	// ... and I respond with the agent state
 	return ActionResponse{
-		Error:      false,
 		StatusCode: http.StatusOK,
 		Payload: struct {
 			Name   string       `json:"name"`
 			Memory mem          `json:"memory"`
 			Pool   [][]poolElem `json:"pool"`
 		}{
-			Name:   agentName,
+			Name:   action.AgentName,
 			Memory: m,
 			Pool:   p,
 		},
 	}
 }
 
-func doInput(action Action, ends map[string]*schema.Endpoint) ActionResponse {
-	// I get the payload...
-	payload := action.Payload.(struct {
-		agentName string
-		actions   string
-	})
-	// ... I send an input request...
+func doInput(action Action, agent *endpoint.Agent) ActionResponse {
+	// I get the memory of the agent, asking it if it is not known...
+	if action.Memory == nil {
+		state, err := requestMemory(action.Context, agent)
+		if err != nil {
+			return requestError(action, err)
+		}
+		action.Memory = &state.Memory
+	}
+	// ... I get the actions from the payload...
+	input, ok := action.Payload.(string)
+	rendered := ""
+	if ok {
+		// ... checking their syntax and their resources...
+		assignments, diagnostics := actions.Parse(input)
+		if len(diagnostics) == 0 {
+			diagnostics = actions.Check(assignments, *action.Memory)
+		}
+		if len(diagnostics) > 0 {
+			return errorResponse(invalidActions(action.AgentName, diagnostics))
+		}
+	} else {
+		// ... or rendering the structured input against the memory, looking
+		// for the type of a single resource input...
+		memory := *action.Memory
+		structured, ok := action.Payload.(memoryInput)
+		if !ok {
+			r := action.Payload.(resourceInput)
+			t, _, found := findResource(memory, r.name)
+			if !found {
+				return errorResponse(NewError(ErrorCodeUnknownResource, action.AgentName, "unknown resource \"%s\"", r.name))
+			}
+			if r.typ != "" {
+				t = r.typ
+			}
+			structured = memoryInput{t: {r.name: r.value}}
+		}
+		var problems []inputProblem
+		input, problems = structured.render(memory)
+		if len(problems) > 0 {
+			apiErr := NewError(ErrorCodeInvalidInput, action.AgentName, "the input does not match the memory of the agent")
+			apiErr.Details = problems
+			return errorResponse(apiErr)
+		}
+		rendered = input
+	}
+	// ... and I send an input request, waiting for the answer
 	msgpayload := schema.EndpointMessagePayloadInputREQ{
-		Input: payload.actions,
+		Input: input,
 	}
-	err := sendMessageByName(payload.agentName, ends, &schema.EndpointMessage{
+	msg, err := sendRequest(action.Context, agent, &schema.EndpointMessage{
 		Type:    schema.EndpointMessageTypeInputREQ,
 		Payload: &msgpayload,
 	})
 	if err != nil {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
-	}
-	// ... and I receive the answer
-	msg, err := receiveMessageByName(payload.agentName, ends)
-	if err != nil || msg.Type != schema.EndpointMessageTypeInputRES {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusInternalServerError,
-			Payload:    err.Error(),
-		}
+		return requestError(action, err)
 	}
 	// I get the eventual error from the answer...
-	errInput := msg.Payload.(*schema.EndpointMessagePayloadInputRES).Error
+	payload, ok := msg.Payload.(*schema.EndpointMessagePayloadInputRES)
+	if msg.Type != schema.EndpointMessageTypeInputRES || !ok {
+		return unexpectedResponse(action)
+	}
+	errInput := payload.Error
 	if errInput != "" {
-		log.Println(errInput)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusBadRequest,
-			Payload:    errInput,
-		}
+		return errorResponse(NewError(ErrorCodeRejectedInput, action.AgentName, "%s", errInput))
 	}
-	// and, if there is none, I respond affirmatively
+	// and, if there is none, I respond affirmatively, with the actions
+	// rendered from the structured input
 	return ActionResponse{
-		Error:      false,
 		StatusCode: http.StatusOK,
 		Payload: struct {
-			Result string `json:"result"`
+			Result  string `json:"result"`
+			Actions string `json:"actions,omitempty"`
 		}{
-			Result: "ok",
+			Result:  "ok",
+			Actions: rendered,
 		},
 	}
 }
 
-func doDebugGet(action Action, ends map[string]*schema.Endpoint) ActionResponse {
-	// I get the agent name...
-	agentName := action.Payload.(string)
-	// ... I send a debug request...
-	err := sendMessageByName(agentName, ends, &schema.EndpointMessage{
-		Type:    schema.EndpointMessageTypeDebugREQ,
-		Payload: nil,
-	})
+func doResourceGet(action Action, agent *endpoint.Agent) ActionResponse {
+	// I get the resource name from the payload...
+	name := action.Payload.(string)
+	// ... I request the state...
+	state, err := requestMemory(action.Context, agent)
 	if err != nil {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
+		return requestError(action, err)
 	}
-	// ... and I receive the answer
-	msg, err := receiveMessageByName(agentName, ends)
-	if err != nil {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
-	}
-	if msg.Type != schema.EndpointMessageTypeDebugRES {
-		err := errors.New("unexpected response")
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
+	observed := time.Now()
+	// ... I look for the resource...
+	t, value, ok := findResource(state.Memory, name)
+	if !ok {
+		return errorResponse(NewError(ErrorCodeUnknownResource, action.AgentName, "unknown resource \"%s\"", name))
 	}
-	// I get the state from the answer...
-	dbgStatus := msg.Payload.(*schema.EndpointMessagePayloadDebugRES)
-	// ... I prepare the status...
-	type status struct {
-		Paused    bool   `json:"paused"`
-		Verbosity string `json:"verbosity"`
+	// ... and I respond with it
+	return ActionResponse{
+		StatusCode: http.StatusOK,
+		Payload: struct {
+			Name     string      `json:"name"`
+			Resource string      `json:"resource"`
+			Type     string      `json:"type"`
+			Value    interface{} `json:"value"`
+			Observed time.Time   `json:"observed"`
+		}{
+			Name:     action.AgentName,
+			Resource: name,
+			Type:     t,
+			Value:    value,
+			Observed: observed,
+		},
 	}
-	s := status{
-		Paused:    dbgStatus.Paused,
-		Verbosity: dbgStatus.Verbosity,
+}
+
+func doDebugGet(action Action, agent *endpoint.Agent) ActionResponse {
+	// I request the debug status...
+	status, err := requestDebugStatus(action.Context, agent)
+	if err != nil {
+		return requestError(action, err)
 	}
-	// ... and I respond with the agent debug status
+	// ... and I respond with it
 	return ActionResponse{
-		Error:      false,
 		StatusCode: http.StatusOK,
 		Payload: struct {
-			Name   string `json:"name"`
-			Status status `json:"status"`
+			Name   string      `json:"name"`
+			Status debugStatus `json:"status"`
 		}{
-			Name:   agentName,
-			Status: s,
+			Name:   action.AgentName,
+			Status: status,
 		},
 	}
 }
 
-func doDebugSet(action Action, ends map[string]*schema.Endpoint) ActionResponse {
+func doDebugSet(action Action, agent *endpoint.Agent) ActionResponse {
 	// I get the payload...
 	payload := action.Payload.(struct {
-		agentName string
 		paused    bool
 		verbosity string
 	})
-	// ... I send a debug status change request...
+	// ... and I send a debug status change request, waiting for the answer
 	msgpayload := schema.EndpointMessagePayloadDebugChangeREQ{
 		Paused:    payload.paused,
 		Verbosity: payload.verbosity,
 	}
-	err := sendMessageByName(payload.agentName, ends, &schema.EndpointMessage{
+	msg, err := sendRequest(action.Context, agent, &schema.EndpointMessage{
 		Type:    schema.EndpointMessageTypeDebugChangeREQ,
 		Payload: &msgpayload,
 	})
 	if err != nil {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
+		return requestError(action, err)
 	}
-	// ... and I receive the answer
-	msg, err := receiveMessageByName(payload.agentName, ends)
-	if err != nil || msg.Type != schema.EndpointMessageTypeDebugChangeRES {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusInternalServerError,
-			Payload:    err.Error(),
-		}
+	if msg.Type != schema.EndpointMessageTypeDebugChangeRES {
+		return unexpectedResponse(action)
 	}
 	// Finally, I respond affirmatively
 	return ActionResponse{
-		Error:      false,
 		StatusCode: http.StatusOK,
 		Payload: struct {
 			Result string `json:"result"`
@@ -366,44 +339,20 @@ func doDebugSet(action Action, ends map[string]*schema.Endpoint) ActionResponse
 	}
 }
 
-func doDebugStep(action Action, ends map[string]*schema.Endpoint) ActionResponse {
-	// I get the agent name...
-	agentName := action.Payload.(string)
-	// ... I send a configuration request...
-	err := sendMessageByName(agentName, ends, &schema.EndpointMessage{
+func doDebugStep(action Action, agent *endpoint.Agent) ActionResponse {
+	// I send a debug step request, waiting for the answer
+	msg, err := sendRequest(action.Context, agent, &schema.EndpointMessage{
 		Type:    schema.EndpointMessageTypeDebugStepREQ,
 		Payload: nil,
 	})
 	if err != nil {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
-	}
-	// ... and I receive the answer
-	msg, err := receiveMessageByName(agentName, ends)
-	if err != nil {
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
+		return requestError(action, err)
 	}
 	if msg.Type != schema.EndpointMessageTypeDebugStepRES {
-		err := errors.New("unexpected response")
-		log.Println(err)
-		return ActionResponse{
-			Error:      true,
-			StatusCode: http.StatusNotFound,
-			Payload:    err.Error(),
-		}
+		return unexpectedResponse(action)
 	}
 	// Finally, I respond affirmatively
 	return ActionResponse{
-		Error:      false,
 		StatusCode: http.StatusOK,
 		Payload: struct {
 			Result string `json:"result"`
@@ -412,3 +361,60 @@ func doDebugStep(action Action, ends map[string]*schema.Endpoint) ActionResponse
 		},
 	}
 }
+
+// requestMemory sends a memory request to an agent and returns its state
+func requestMemory(ctx context.Context, agent *endpoint.Agent) (*schema.EndpointMessagePayloadMemoryRES, error) {
+	// I send a memory request, waiting for the answer...
+	msg, err := sendRequest(ctx, agent, &schema.EndpointMessage{
+		Type:    schema.EndpointMessageTypeMemoryREQ,
+		Payload: nil,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// ... and I get the state from the answer
+	payload, ok := msg.Payload.(*schema.EndpointMessagePayloadMemoryRES)
+	if msg.Type != schema.EndpointMessageTypeMemoryRES || !ok {
+		return nil, NewError(ErrorCodeProtocolError, agent.Name, "unexpected response")
+	}
+	return payload, nil
+}
+
+// debugStatus represents the debug status of an agent
+type debugStatus struct {
+	Paused    bool   `json:"paused"`
+	Verbosity string `json:"verbosity"`
+}
+
+// requestDebugStatus sends a debug request to an agent and returns its
+// debug status
+func requestDebugStatus(ctx context.Context, agent *endpoint.Agent) (debugStatus, error) {
+	// I send a debug request, waiting for the answer...
+	msg, err := sendRequest(ctx, agent, &schema.EndpointMessage{
+		Type:    schema.EndpointMessageTypeDebugREQ,
+		Payload: nil,
+	})
+	if err != nil {
+		return debugStatus{}, err
+	}
+	// ... and I get the status from the answer
+	payload, ok := msg.Payload.(*schema.EndpointMessagePayloadDebugRES)
+	if msg.Type != schema.EndpointMessageTypeDebugRES || !ok {
+		return debugStatus{}, NewError(ErrorCodeProtocolError, agent.Name, "unexpected response")
+	}
+	return debugStatus{
+		Paused:    payload.Paused,
+		Verbosity: payload.Verbosity,
+	}, nil
+}
+
+// unexpectedResponse returns the response for an agent answering with an
+// unexpected message
+func unexpectedResponse(action Action) ActionResponse {
+	return errorResponse(NewError(ErrorCodeProtocolError, action.AgentName, "unexpected response"))
+}
+
+// requestError returns the response for a failed request to an agent
+func requestError(action Action, err error) ActionResponse {
+	return errorResponse(classifyError(action.AgentName, err))
+}
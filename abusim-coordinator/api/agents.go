@@ -0,0 +1,214 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/abu-lang/abusim-core/abusim-coordinator/endpoint"
+
+	"github.com/abu-lang/abusim-core/schema"
+
+	"github.com/gorilla/mux"
+)
+
+// agentProtocol represents the protocol negotiated with an agent
+type agentProtocol struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	Codec        string   `json:"codec"`
+	Compression  string   `json:"compression"`
+}
+
+// agentInfo represents an agent as known by the coordinator, with its debug
+// status or the reason why it is not available
+type agentInfo struct {
+	Name          string            `json:"name"`
+	RemoteAddr    string            `json:"remoteaddr"`
+	ConnectedAt   time.Time         `json:"connectedat"`
+	LastSeen      time.Time         `json:"lastseen"`
+	LastRoundTrip *time.Time        `json:"lastroundtrip"`
+	RoundTrip     string            `json:"roundtrip,omitempty"`
+	State         string            `json:"state"`
+	Labels        map[string]string `json:"labels"`
+	Debug         *debugStatus      `json:"debug"`
+	DebugError    *Error            `json:"debugerror,omitempty"`
+	Protocol      agentProtocol     `json:"protocol"`
+}
+
+// GetHandleAgents returns an handler for the agents listing method
+func GetHandleAgents(d *Dispatcher) http.HandlerFunc {
+	// I return the handler, decorated with the dispatcher
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I get the selector from the query...
+		selector, err := parseSelector(r.URL.Query().Get("selector"))
+		if err != nil {
+			apiErr := NewError(ErrorCodeBadRequest, "", "%v", err)
+			log.Println(apiErr)
+			writeError(w, apiErr)
+			return
+		}
+		// ... I select the agents...
+		agents := []*endpoint.Agent{}
+		for _, agent := range d.reg.Agents() {
+			if selector.matches(agent.Labels()) {
+				agents = append(agents, agent)
+			}
+		}
+		// ... I describe them, asking them their debug status at the same
+		// time...
+		infos := make([]agentInfo, len(agents))
+		var wg sync.WaitGroup
+		for i, agent := range agents {
+			wg.Add(1)
+			go func(i int, agent *endpoint.Agent) {
+				defer wg.Done()
+				infos[i] = describeAgent(r.Context(), agent, d.timeout)
+			}(i, agent)
+		}
+		wg.Wait()
+		// ... and I respond with them
+		writeResponse(w, http.StatusOK, infos)
+	}
+}
+
+// GetHandleAgent returns an handler for the agent detail method
+func GetHandleAgent(d *Dispatcher) http.HandlerFunc {
+	// I return the handler, decorated with the dispatcher
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I get the agent name from the query...
+		vars := mux.Vars(r)
+		agentName := vars["agentName"]
+		// ... I look for the agent...
+		agent, ok := d.reg.Lookup(agentName)
+		if !ok {
+			apiErr := NewError(ErrorCodeUnknownAgent, agentName, "unknown agent")
+			log.Println(apiErr)
+			writeError(w, apiErr)
+			return
+		}
+		// ... I describe it, with the health of its connection...
+		frameErrors, lastFrameError := agent.FrameErrors()
+		lastError := ""
+		if lastFrameError != nil {
+			lastError = lastFrameError.Error()
+		}
+		// ... and I respond with the details
+		writeResponse(w, http.StatusOK, struct {
+			agentInfo
+			Desyncs        int    `json:"desyncs"`
+			FrameErrors    int    `json:"frameerrors"`
+			LastFrameError string `json:"lastframeerror,omitempty"`
+			DroppedPushes  int    `json:"droppedpushes"`
+		}{
+			agentInfo:      describeAgent(r.Context(), agent, d.timeout),
+			Desyncs:        agent.Mux.Desyncs(),
+			FrameErrors:    frameErrors,
+			LastFrameError: lastError,
+			DroppedPushes:  agent.Mux.DroppedPushes(),
+		})
+	}
+}
+
+// GetHandleLabels returns an handler for the labels method
+func GetHandleLabels(reg *endpoint.Registry) http.HandlerFunc {
+	// I return the handler, decorated with the registry
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I get the agent name from the query...
+		vars := mux.Vars(r)
+		agentName := vars["agentName"]
+		// ... I look for the agent...
+		agent, ok := reg.Lookup(agentName)
+		if !ok {
+			apiErr := NewError(ErrorCodeUnknownAgent, agentName, "unknown agent")
+			log.Println(apiErr)
+			writeError(w, apiErr)
+			return
+		}
+		// ... and I respond with its labels
+		writeResponse(w, http.StatusOK, agent.Labels())
+	}
+}
+
+// GetHandleLabel returns an handler for the label change method
+func GetHandleLabel(reg *endpoint.Registry) http.HandlerFunc {
+	// I return the handler, decorated with the registry
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I get the agent name and the label key from the query...
+		vars := mux.Vars(r)
+		agentName := vars["agentName"]
+		key := vars["key"]
+		// ... I look for the agent...
+		agent, ok := reg.Lookup(agentName)
+		if !ok {
+			apiErr := NewError(ErrorCodeUnknownAgent, agentName, "unknown agent")
+			log.Println(apiErr)
+			writeError(w, apiErr)
+			return
+		}
+		// ... and I check what do I have to do
+		switch r.Method {
+		// If I need to set the label...
+		case http.MethodPut:
+			// ... I parse the request body to extract the value...
+			type request struct {
+				Value string `json:"value"`
+			}
+			req := request{}
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err == nil {
+				err = schema.ValidateLabels(map[string]string{key: req.Value})
+			}
+			if err != nil {
+				apiErr := NewError(ErrorCodeBadRequest, agentName, "%v", err)
+				log.Println(apiErr)
+				writeError(w, apiErr)
+				return
+			}
+			// ... and I set it
+			agent.SetLabel(key, req.Value)
+		// If I need to remove the label, I remove it
+		case http.MethodDelete:
+			agent.RemoveLabel(key)
+		}
+		// Finally, I respond with the labels of the agent
+		writeResponse(w, http.StatusOK, agent.Labels())
+	}
+}
+
+// describeAgent returns the description of an agent, requesting its debug
+// status within the specified timeout
+func describeAgent(ctx context.Context, agent *endpoint.Agent, timeout time.Duration) agentInfo {
+	// I ask the agent its debug status...
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	status, err := requestDebugStatus(ctx, agent)
+	// ... and I describe it with what I know
+	info := agentInfo{
+		Name:        agent.Name,
+		RemoteAddr:  agent.RemoteAddr,
+		ConnectedAt: agent.ConnectedAt,
+		LastSeen:    agent.LastSeen(),
+		State:       agent.State().String(),
+		Labels:      agent.Labels(),
+		Protocol: agentProtocol{
+			Version:      agent.Version,
+			Capabilities: agent.Capabilities,
+			Codec:        agent.Codec,
+			Compression:  agent.Compression,
+		},
+	}
+	if last, roundTrip := agent.Mux.LastRoundTrip(); !last.IsZero() {
+		info.LastRoundTrip = &last
+		info.RoundTrip = roundTrip.String()
+	}
+	if err != nil {
+		info.DebugError = classifyError(agent.Name, err)
+	} else {
+		info.Debug = &status
+	}
+	return info
+}
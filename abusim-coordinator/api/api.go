@@ -1,10 +1,14 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/abu-lang/abusim-core/abusim-coordinator/endpoint"
 
 	"github.com/abu-lang/abusim-core/schema"
 
@@ -12,26 +16,52 @@ import (
 	"github.com/rs/cors"
 )
 
+// Config represents the configuration of the API
+type Config struct {
+	// RequestTimeout is the maximum duration of an action on an agent
+	RequestTimeout time.Duration
+	// PollInterval is the time between two polls of the memory of an agent
+	// whose changes are streamed
+	PollInterval time.Duration
+}
+
+// allowedOrigins lists the origins allowed to use the API from a browser
+var allowedOrigins = []string{"http://localhost", "http://localhost:*"}
+
 // Serve serves the API on the API port
-func Serve(ends map[string]*schema.Endpoint) {
-	// I create the channels to serialize the actions...
-	actions := make(chan Action)
-	responses := make(chan ActionResponse)
+func Serve(reg *endpoint.Registry, cfg Config) {
+	// I create the hub to observe the memory of the agents...
+	h := NewHub(reg, cfg.PollInterval, cfg.RequestTimeout)
+	// ... I create the dispatcher to perform the actions on the agents...
+	d := NewDispatcher(reg, h, cfg.RequestTimeout)
 	// ... I create a router for the API and I set the handlers...
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/", HandleIndex)
-	router.HandleFunc("/config/{agentName}", GetHandleConfig(actions, responses)).Methods(http.MethodGet)
-	router.HandleFunc("/memory/{agentName}", GetHandleMemory(actions, responses)).Methods(http.MethodGet, http.MethodPost)
-	router.HandleFunc("/debug/{agentName}", GetHandleDebug(actions, responses)).Methods(http.MethodGet, http.MethodPost)
-	router.HandleFunc("/debug/{agentName}/step", GetHandleDebugStep(actions, responses)).Methods(http.MethodPost)
+	router.HandleFunc("/events", GetHandleEvents(h)).Methods(http.MethodGet)
+	router.HandleFunc("/agents", GetHandleAgents(d)).Methods(http.MethodGet)
+	router.HandleFunc("/agents/{agentName}", GetHandleAgent(d)).Methods(http.MethodGet)
+	router.HandleFunc("/agents/{agentName}/labels", GetHandleLabels(reg)).Methods(http.MethodGet)
+	router.HandleFunc("/agents/{agentName}/labels/{key:.+}", GetHandleLabel(reg)).Methods(http.MethodPut, http.MethodDelete)
+	router.HandleFunc("/config/{agentName}", GetHandleConfig(d)).Methods(http.MethodGet)
+	router.HandleFunc("/memory", GetHandleMemoryAll(d)).Methods(http.MethodGet, http.MethodPost)
+	router.HandleFunc("/debug", GetHandleDebugAll(d)).Methods(http.MethodGet, http.MethodPost)
+	// The step on several agents comes first, so that an agent named step
+	// can still be addressed without selecting agents in the query
+	router.HandleFunc("/debug/step", GetHandleDebugStepAll(d)).Methods(http.MethodPost).MatcherFunc(isFanOut)
+	router.HandleFunc("/memory/{agentName}", GetHandleMemory(d)).Methods(http.MethodGet, http.MethodPost)
+	router.HandleFunc("/memory/{agentName}/events", GetHandleMemoryEvents(h, reg)).Methods(http.MethodGet)
+	router.HandleFunc("/memory/{agentName}/{resource}", GetHandleResource(d)).Methods(http.MethodGet, http.MethodPut)
+	router.HandleFunc("/debug/{agentName}", GetHandleDebug(d)).Methods(http.MethodGet, http.MethodPost)
+	router.HandleFunc("/debug/{agentName}/step", GetHandleDebugStep(d)).Methods(http.MethodPost)
+	router.HandleFunc("/stats/{agentName}", GetHandleStats(reg)).Methods(http.MethodGet)
+	router.HandleFunc("/lint/actions", GetHandleLint(d)).Methods(http.MethodPost)
+	router.HandleFunc("/rpc", GetHandleRPC(d, h)).Methods(http.MethodGet)
 	// ... I set up the CORS middleware...
 	c := cors.New(cors.Options{
-		AllowedOrigins: []string{"http://localhost", "http://localhost:*"},
-		AllowedMethods: []string{"POST", "GET"},
+		AllowedOrigins: allowedOrigins,
+		AllowedMethods: []string{"POST", "GET", "PUT", "DELETE"},
 		AllowedHeaders: []string{"Accept", "content-type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization"},
 	})
-	// ... I run the action processing function...
-	go Process(actions, responses, ends)
 	// ... and I serve the CORS decorated API
 	log.Fatal(http.ListenAndServe(":4000", c.Handler(router)))
 }
@@ -52,84 +82,151 @@ func HandleIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetHandleConfig returns an handler for the configuration method
-func GetHandleConfig(actions chan Action, responses chan ActionResponse) http.HandlerFunc {
-	// I return the handler, decorated with the list of endpoints
+func GetHandleConfig(d *Dispatcher) http.HandlerFunc {
+	// I return the handler, decorated with the dispatcher
 	return func(w http.ResponseWriter, r *http.Request) {
 		// I get the agent name from the query...
 		vars := mux.Vars(r)
 		agentName := vars["agentName"]
-		// ... and I add a new action to process
-		actions <- Action{
-			Type:    ActionConfig,
-			Payload: agentName,
-		}
-		// I get the response and I return it
-		writeActionResponse(w, <-responses)
+		// ... I perform a new action...
+		res := d.Do(r.Context(), Action{
+			Type:      ActionConfig,
+			AgentName: agentName,
+		})
+		// ... and I return its response
+		writeActionResponse(w, res)
 	}
 }
 
 // GetHandleMemory returns an handler for the memory method
-func GetHandleMemory(actions chan Action, responses chan ActionResponse) http.HandlerFunc {
-	// I return the handler, decorated with the list of endpoints
+func GetHandleMemory(d *Dispatcher) http.HandlerFunc {
+	// I return the handler, decorated with the dispatcher
 	return func(w http.ResponseWriter, r *http.Request) {
 		// I get the agent name from the query...
 		vars := mux.Vars(r)
 		agentName := vars["agentName"]
 		// ... and I check what do I have to do
+		var res ActionResponse
 		switch r.Method {
 		// If I need to retrieve the memory...
 		case http.MethodGet:
-			// ... I add a new action to process
-			actions <- Action{
-				Type:    ActionMemory,
-				Payload: agentName,
+			// ... I get the resources to select from the query...
+			query := r.URL.Query()
+			payload, apiErr := memoryPayload(agentName, query.Get("fields"), query.Get("types"))
+			if apiErr != nil {
+				log.Println(apiErr)
+				writeError(w, apiErr)
+				return
 			}
+			// ... and I perform a new action
+			res = d.Do(r.Context(), Action{
+				Type:      ActionMemory,
+				AgentName: agentName,
+				Payload:   payload,
+			})
 		// If I need to do an input...
 		case http.MethodPost:
-			// ... I parse the request body to extract the input payload...
+			// ... I parse the request body to extract the input payload,
+			// either the actions or the structured input...
 			type request struct {
-				Actions string `json:"actions"`
+				Actions string      `json:"actions"`
+				Memory  memoryInput `json:"memory"`
 			}
 			req := request{}
 			err := json.NewDecoder(r.Body).Decode(&req)
 			if err != nil {
-				log.Println(err)
-				writeError(w, http.StatusBadRequest, err.Error())
+				apiErr := NewError(ErrorCodeBadRequest, agentName, "%v", err)
+				log.Println(apiErr)
+				writeError(w, apiErr)
 				return
 			}
-			// ... and I add a new action to process
-			actions <- Action{
-				Type: ActionInput,
-				Payload: struct {
-					agentName string
-					actions   string
-				}{
-					agentName,
-					req.Actions,
-				},
+			payload, apiErr := inputPayload(agentName, req.Actions, req.Memory)
+			if apiErr != nil {
+				log.Println(apiErr)
+				writeError(w, apiErr)
+				return
 			}
+			// ... and I perform a new action
+			res = d.Do(r.Context(), Action{
+				Type:      ActionInput,
+				AgentName: agentName,
+				Payload:   payload,
+			})
 		}
-		// I get the response and I return it
-		writeActionResponse(w, <-responses)
+		// I return the response
+		writeActionResponse(w, res)
+	}
+}
+
+// GetHandleResource returns an handler for the single resource method
+func GetHandleResource(d *Dispatcher) http.HandlerFunc {
+	// I return the handler, decorated with the dispatcher
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I get the agent and the resource names from the query...
+		vars := mux.Vars(r)
+		agentName := vars["agentName"]
+		resource := vars["resource"]
+		// ... and I check what do I have to do
+		var res ActionResponse
+		switch r.Method {
+		// If I need to retrieve the resource, I perform a new action...
+		case http.MethodGet:
+			res = d.Do(r.Context(), Action{
+				Type:      ActionResource,
+				AgentName: agentName,
+				Payload:   resource,
+			})
+		// ... if I need to change it, I parse the request body to extract
+		// the value and, optionally, the expected type...
+		case http.MethodPut:
+			type request struct {
+				Value json.RawMessage `json:"value"`
+				Type  string          `json:"type"`
+			}
+			req := request{}
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err == nil && req.Value == nil {
+				err = fmt.Errorf("missing value")
+			}
+			if err != nil {
+				apiErr := NewError(ErrorCodeBadRequest, agentName, "%v", err)
+				log.Println(apiErr)
+				writeError(w, apiErr)
+				return
+			}
+			// ... and I perform a new input action
+			res = d.Do(r.Context(), Action{
+				Type:      ActionInput,
+				AgentName: agentName,
+				Payload: resourceInput{
+					name:  resource,
+					typ:   req.Type,
+					value: req.Value,
+				},
+			})
+		}
+		// I return the response
+		writeActionResponse(w, res)
 	}
 }
 
 // GetHandleDebug returns an handler for the debug method
-func GetHandleDebug(actions chan Action, responses chan ActionResponse) http.HandlerFunc {
-	// I return the handler, decorated with the list of endpoints
+func GetHandleDebug(d *Dispatcher) http.HandlerFunc {
+	// I return the handler, decorated with the dispatcher
 	return func(w http.ResponseWriter, r *http.Request) {
 		// I get the agent name from the query...
 		vars := mux.Vars(r)
 		agentName := vars["agentName"]
 		// ... and I check what do I have to do
+		var res ActionResponse
 		switch r.Method {
 		// If I need to retrieve the debug state...
 		case http.MethodGet:
-			// ... I add a new action to process
-			actions <- Action{
-				Type:    ActionDebugInfo,
-				Payload: agentName,
-			}
+			// ... I perform a new action
+			res = d.Do(r.Context(), Action{
+				Type:      ActionDebugInfo,
+				AgentName: agentName,
+			})
 		// If I need to change the debug status...
 		case http.MethodPost:
 			// ... I parse the request body to extract the status payload...
@@ -140,97 +237,231 @@ func GetHandleDebug(actions chan Action, responses chan ActionResponse) http.Han
 			req := request{}
 			err := json.NewDecoder(r.Body).Decode(&req)
 			if err != nil {
-				log.Println(err)
-				writeError(w, http.StatusBadRequest, err.Error())
+				apiErr := NewError(ErrorCodeBadRequest, agentName, "%v", err)
+				log.Println(apiErr)
+				writeError(w, apiErr)
 				return
 			}
-			actions <- Action{
-				Type: ActionDebugSet,
+			// ... and I perform a new action
+			res = d.Do(r.Context(), Action{
+				Type:      ActionDebugSet,
+				AgentName: agentName,
 				Payload: struct {
-					agentName string
 					paused    bool
 					verbosity string
 				}{
-					agentName,
 					req.Paused,
 					req.Verbosity,
 				},
-			}
+			})
 		}
-		// I get the response and I return it
-		writeActionResponse(w, <-responses)
+		// I return the response
+		writeActionResponse(w, res)
 	}
 }
 
 // GetHandleDebugStep returns an handler for the debug step method
-func GetHandleDebugStep(actions chan Action, responses chan ActionResponse) http.HandlerFunc {
-	// I return the handler, decorated with the list of endpoints
+func GetHandleDebugStep(d *Dispatcher) http.HandlerFunc {
+	// I return the handler, decorated with the dispatcher
 	return func(w http.ResponseWriter, r *http.Request) {
 		// I get the agent name from the query...
 		vars := mux.Vars(r)
 		agentName := vars["agentName"]
-		// ... and I add a new action to process
-		actions <- Action{
-			Type:    ActionDebugStep,
-			Payload: agentName,
+		// ... I perform a new action...
+		res := d.Do(r.Context(), Action{
+			Type:      ActionDebugStep,
+			AgentName: agentName,
+		})
+		// ... and I return its response
+		writeActionResponse(w, res)
+	}
+}
+
+// GetHandleStats returns an handler for the traffic statistics method
+func GetHandleStats(reg *endpoint.Registry) http.HandlerFunc {
+	// I return the handler, decorated with the registry
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I get the agent name from the query...
+		vars := mux.Vars(r)
+		agentName := vars["agentName"]
+		// ... I look for the agent, without contacting it...
+		agent, ok := reg.Lookup(agentName)
+		if !ok {
+			apiErr := NewError(ErrorCodeUnknownAgent, agentName, "unknown agent")
+			log.Println(apiErr)
+			writeError(w, apiErr)
+			return
+		}
+		// ... I prepare the traffic in both directions...
+		type traffic struct {
+			Frames           int64 `json:"frames"`
+			CompressedFrames int64 `json:"compressedframes"`
+			Bytes            int64 `json:"bytes"`
+			MessageBytes     int64 `json:"messagebytes"`
 		}
-		// I get the response and I return it
-		writeActionResponse(w, <-responses)
+		stats := agent.Stats()
+		frameErrors, lastFrameError := agent.FrameErrors()
+		lastError := ""
+		if lastFrameError != nil {
+			lastError = lastFrameError.Error()
+		}
+		// ... and I respond with the statistics
+		writeResponse(w, http.StatusOK, struct {
+			Name             string  `json:"name"`
+			Codec            string  `json:"codec"`
+			Compression      string  `json:"compression"`
+			CompressionRatio float64 `json:"compressionratio"`
+			Read             traffic `json:"read"`
+			Written          traffic `json:"written"`
+			FrameErrors      int     `json:"frameerrors"`
+			LastFrameError   string  `json:"lastframeerror,omitempty"`
+			DroppedPushes    int     `json:"droppedpushes"`
+		}{
+			Name:             agent.Name,
+			Codec:            agent.Codec,
+			Compression:      agent.Compression,
+			CompressionRatio: stats.CompressionRatio(),
+			Read: traffic{
+				Frames:           stats.FramesRead,
+				CompressedFrames: stats.CompressedRead,
+				Bytes:            stats.BytesRead,
+				MessageBytes:     stats.MessageBytesRead,
+			},
+			Written: traffic{
+				Frames:           stats.FramesWritten,
+				CompressedFrames: stats.CompressedWritten,
+				Bytes:            stats.BytesWritten,
+				MessageBytes:     stats.MessageBytesWritten,
+			},
+			FrameErrors:    frameErrors,
+			LastFrameError: lastError,
+			DroppedPushes:  agent.Mux.DroppedPushes(),
+		})
 	}
 }
 
-// sendMessageByName sends a message to an agent, given its name
-func sendMessageByName(agentName string, ends map[string]*schema.Endpoint, message *schema.EndpointMessage) error {
-	// I check if the agent exists...
-	end, ok := ends[agentName]
-	if !ok {
-		return fmt.Errorf("unknown agent \"%s\"", agentName)
+// GetHandleEvents returns an handler for the memory events stream of all
+// the agents, or of the ones selected by the query
+func GetHandleEvents(h *Hub) http.HandlerFunc {
+	// I return the handler, decorated with the hub
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I get the filter from the query...
+		query := r.URL.Query()
+		resources, err := parseResourceFilter(query.Get("resources"), query.Get("types"))
+		if err != nil {
+			apiErr := NewError(ErrorCodeBadRequest, "", "%v", err)
+			log.Println(apiErr)
+			writeError(w, apiErr)
+			return
+		}
+		// ... and I stream the events
+		streamEvents(w, r, h, eventFilter{
+			agents:    parseSet(query.Get("agents")),
+			resources: resources,
+		})
 	}
-	// ... and I write the message
-	err := end.Write(message)
-	if err != nil {
-		return err
+}
+
+// GetHandleMemoryEvents returns an handler for the memory events stream of
+// an agent
+func GetHandleMemoryEvents(h *Hub, reg *endpoint.Registry) http.HandlerFunc {
+	// I return the handler, decorated with the hub and the registry
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I get the agent name from the query...
+		vars := mux.Vars(r)
+		agentName := vars["agentName"]
+		// ... I check that the agent exists...
+		if _, ok := reg.Lookup(agentName); !ok {
+			apiErr := NewError(ErrorCodeUnknownAgent, agentName, "unknown agent")
+			log.Println(apiErr)
+			writeError(w, apiErr)
+			return
+		}
+		// ... I get the filter from the query...
+		query := r.URL.Query()
+		resources, err := parseResourceFilter(query.Get("resources"), query.Get("types"))
+		if err != nil {
+			apiErr := NewError(ErrorCodeBadRequest, agentName, "%v", err)
+			log.Println(apiErr)
+			writeError(w, apiErr)
+			return
+		}
+		// ... and I stream the events
+		streamEvents(w, r, h, eventFilter{
+			agents:    map[string]bool{agentName: true},
+			resources: resources,
+		})
 	}
-	return nil
 }
 
-// receiveMessageByName receives a message from an agent, given its name
-func receiveMessageByName(agentName string, ends map[string]*schema.Endpoint) (*schema.EndpointMessage, error) {
-	// I check if the agent exists...
-	end, ok := ends[agentName]
+// keepAliveInterval is the time between two comments keeping an idle
+// events stream open
+const keepAliveInterval = 15 * time.Second
+
+// streamEvents streams the memory events selected by a filter as
+// Server-Sent Events, until the client goes away
+func streamEvents(w http.ResponseWriter, r *http.Request, h *Hub, filter eventFilter) {
+	// I check that the response can be streamed...
+	flusher, ok := w.(http.Flusher)
 	if !ok {
-		return nil, fmt.Errorf("unknown agent \"%s\"", agentName)
+		apiErr := NewError(ErrorCodeInternal, "", "streaming not supported")
+		log.Println(apiErr)
+		writeError(w, apiErr)
+		return
 	}
-	// ... and I read the message
-	msg, err := end.Read()
-	if err != nil {
-		return nil, err
+	// ... I subscribe to the events...
+	events, cancel := h.Subscribe(filter)
+	defer cancel()
+	// ... I write the headers...
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	// ... and I write the events as they arrive
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			b, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: memory\ndata: %s\n\n", b)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
 	}
-	return msg, nil
+}
+
+// sendRequest sends a request to an agent and waits for the response,
+// until the context is done
+func sendRequest(ctx context.Context, agent *endpoint.Agent, message *schema.EndpointMessage) (*schema.EndpointMessage, error) {
+	return agent.Mux.Request(ctx, message)
 }
 
 // writeActionResponse writes an error or response
 func writeActionResponse(w http.ResponseWriter, res ActionResponse) {
 	// I check whether the Action returned an error or a response and I write it
-	if res.Error {
-		writeError(w, res.StatusCode, res.Payload.(string))
+	if res.Error != nil {
+		writeError(w, res.Error)
 	} else {
 		writeResponse(w, res.StatusCode, res.Payload)
 	}
 }
 
 // writeError writes a JSON error
-func writeError(w http.ResponseWriter, h int, e string) {
+func writeError(w http.ResponseWriter, e *Error) {
 	// I set the content type...
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	// ... I write the specified status code...
-	w.WriteHeader(h)
+	// ... I write the status code of the error...
+	w.WriteHeader(e.StatusCode())
 	// ... and I write the error
-	b, _ := json.Marshal(struct {
-		Error string `json:"error"`
-	}{
-		Error: e,
-	})
+	b, _ := json.Marshal(e)
 	w.Write(b)
 }
 
@@ -0,0 +1,244 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/abu-lang/abusim-core/abusim-coordinator/endpoint"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// worker represents the ordered queue of actions of an agent
+type worker struct {
+	agent   *endpoint.Agent
+	actions chan Action
+	done    chan struct{}
+	stopped chan struct{}
+	debug   *DebugFeed
+	hub     *Hub
+	// layout is a memory of the agent, kept to check the inputs since the
+	// resources of an agent and their types never change
+	layout *schema.MemoryResources
+}
+
+// Dispatcher routes every Action to the worker of its agent, so that the
+// actions on an agent are performed in order without waiting for the others
+type Dispatcher struct {
+	reg     *endpoint.Registry
+	timeout time.Duration
+	lock    sync.Mutex
+	workers map[string]*worker
+	debug   *DebugFeed
+	hub     *Hub
+}
+
+// NewDispatcher creates a new dispatcher, with a worker for every agent
+// that is or will be in the registry, checking the inputs against the
+// memory observed by the hub or read once from the agent, and with the specified maximum duration of
+// an action
+func NewDispatcher(reg *endpoint.Registry, h *Hub, timeout time.Duration) *Dispatcher {
+	// I create the dispatcher...
+	d := &Dispatcher{
+		reg:     reg,
+		timeout: timeout,
+		workers: make(map[string]*worker),
+		debug:   NewDebugFeed(),
+		hub:     h,
+	}
+	// ... I subscribe to the registry events...
+	events, _ := reg.Subscribe()
+	// ... I start the workers of the agents already registered...
+	for _, agent := range reg.Agents() {
+		d.start(agent)
+	}
+	// ... and I follow the registry changes
+	go func() {
+		for event := range events {
+			switch event.Type {
+			case endpoint.RegistryEventJoin:
+				d.start(event.Agent)
+			case endpoint.RegistryEventLeave:
+				d.stop(event.Agent)
+			}
+		}
+	}()
+	return d
+}
+
+// Do performs an Action on its agent and waits for the ActionResponse,
+// until the context is done or the action times out
+func (d *Dispatcher) Do(ctx context.Context, action Action) ActionResponse {
+	// I create the context and the channel for the response...
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	action.Context = ctx
+	action.Response = make(chan ActionResponse, 1)
+	// ... I look for the agent worker...
+	d.lock.Lock()
+	w, ok := d.workers[action.AgentName]
+	d.lock.Unlock()
+	if !ok {
+		return errorResponse(NewError(ErrorCodeUnknownAgent, action.AgentName, "unknown agent"))
+	}
+	// ... I enqueue the action...
+	select {
+	case w.actions <- action:
+	case <-w.done:
+		return agentLeft(action)
+	case <-ctx.Done():
+		return requestError(action, ctx.Err())
+	}
+	// ... and I wait for the response, unless the worker stopped without
+	// taking the action
+	select {
+	case res := <-action.Response:
+		return res
+	case <-w.stopped:
+		select {
+		case res := <-action.Response:
+			return res
+		default:
+			return agentLeft(action)
+		}
+	case <-ctx.Done():
+		return requestError(action, ctx.Err())
+	}
+}
+
+// DoAll performs an Action on several agents at the same time and waits for
+// their ActionResponses, in the same order as the agents
+func (d *Dispatcher) DoAll(ctx context.Context, agentNames []string, action Action) []ActionResponse {
+	responses := make([]ActionResponse, len(agentNames))
+	var wg sync.WaitGroup
+	for i, agentName := range agentNames {
+		wg.Add(1)
+		go func(i int, action Action) {
+			defer wg.Done()
+			responses[i] = d.Do(ctx, action)
+		}(i, Action{
+			Type:      action.Type,
+			AgentName: agentName,
+			Payload:   action.Payload,
+		})
+	}
+	wg.Wait()
+	return responses
+}
+
+// DebugFeed returns the feed of the debug status changes performed by the
+// dispatcher
+func (d *Dispatcher) DebugFeed() *DebugFeed {
+	return d.debug
+}
+
+// start starts the worker of an agent, if it is not running
+func (d *Dispatcher) start(agent *endpoint.Agent) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	// I check whether the agent already has a worker...
+	if w, ok := d.workers[agent.Name]; ok {
+		if w.agent == agent {
+			return
+		}
+		close(w.done)
+	}
+	// ... and, if it has not, I create it and I run it
+	w := &worker{
+		agent:   agent,
+		actions: make(chan Action, 64),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		debug:   d.debug,
+		hub:     d.hub,
+	}
+	d.workers[agent.Name] = w
+	go w.run()
+}
+
+// stop stops the worker of an agent, if it is running
+func (d *Dispatcher) stop(agent *endpoint.Agent) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if w, ok := d.workers[agent.Name]; ok && w.agent == agent {
+		close(w.done)
+		delete(d.workers, agent.Name)
+	}
+}
+
+// run performs the actions of the worker agent in order, until it is stopped
+func (w *worker) run() {
+	defer close(w.stopped)
+	for {
+		select {
+		// I perform the next action...
+		case action := <-w.actions:
+			// If the action was cancelled while in the queue, I skip it
+			if err := action.Context.Err(); err != nil {
+				action.Response <- requestError(action, err)
+				continue
+			}
+			// If the action is an input, I attach the memory of the agent,
+			// to check the resources before sending it
+			if action.Type == ActionInput {
+				memory, err := w.memory(action.Context)
+				if err != nil {
+					action.Response <- requestError(action, err)
+					continue
+				}
+				action.Memory = memory
+			}
+			res := Process(action, w.agent)
+			// If the debug status changed, I publish it
+			if action.Type == ActionDebugSet && res.Error == nil {
+				payload := action.Payload.(struct {
+					paused    bool
+					verbosity string
+				})
+				w.debug.publish(debugEvent{
+					Agent:     w.agent.Name,
+					Time:      time.Now(),
+					Paused:    payload.paused,
+					Verbosity: payload.verbosity,
+				})
+			}
+			action.Response <- res
+		// ... until I am stopped, then I fail the actions left in the queue
+		case <-w.done:
+			for {
+				select {
+				case action := <-w.actions:
+					action.Response <- agentLeft(action)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// agentLeft returns the response for an action whose agent left
+func agentLeft(action Action) ActionResponse {
+	return errorResponse(NewError(ErrorCodeAgentUnreachable, action.AgentName, "the agent left"))
+}
+
+// memory returns the memory to check the inputs against: the one observed by
+// the hub, if known, otherwise the one kept from the previous inputs, asking
+// it to the agent only the first time
+func (w *worker) memory(ctx context.Context) (*schema.MemoryResources, error) {
+	if w.hub != nil {
+		if memory, ok := w.hub.Memory(w.agent); ok {
+			w.layout = &memory
+			return &memory, nil
+		}
+	}
+	if w.layout == nil {
+		state, err := requestMemory(ctx, w.agent)
+		if err != nil {
+			return nil, err
+		}
+		w.layout = &state.Memory
+	}
+	return w.layout, nil
+}
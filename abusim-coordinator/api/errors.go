@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// ErrorCode represents a class of API errors
+type ErrorCode string
+
+const (
+	// ErrorCodeBadRequest means that the API request is malformed
+	ErrorCodeBadRequest ErrorCode = "bad_request"
+	// ErrorCodeUnknownAgent means that no agent has the requested name
+	ErrorCodeUnknownAgent ErrorCode = "unknown_agent"
+	// ErrorCodeUnknownResource means that the agent has no resource with the requested name
+	ErrorCodeUnknownResource ErrorCode = "unknown_resource"
+	// ErrorCodeAgentUnreachable means that the connection to the agent failed
+	ErrorCodeAgentUnreachable ErrorCode = "agent_unreachable"
+	// ErrorCodeAgentTimeout means that the agent did not answer in time
+	ErrorCodeAgentTimeout ErrorCode = "agent_timeout"
+	// ErrorCodeProtocolError means that the agent answered with an unexpected message
+	ErrorCodeProtocolError ErrorCode = "protocol_error"
+	// ErrorCodeRejectedInput means that the agent refused an input
+	ErrorCodeRejectedInput ErrorCode = "rejected_input"
+	// ErrorCodeInvalidInput means that the coordinator refused an input
+	// before sending it to the agent
+	ErrorCodeInvalidInput ErrorCode = "invalid_input"
+	// ErrorCodeRejectedRequest means that the agent refused a request other than an input
+	ErrorCodeRejectedRequest ErrorCode = "rejected_request"
+	// ErrorCodeUnsupported means that the agent does not support the request
+	ErrorCodeUnsupported ErrorCode = "unsupported_request"
+	// ErrorCodeAgentError means that the agent failed executing the request
+	ErrorCodeAgentError ErrorCode = "agent_error"
+	// ErrorCodeTooLarge means that the request to the agent exceeds the maximum frame size
+	ErrorCodeTooLarge ErrorCode = "request_too_large"
+	// ErrorCodeCancelled means that the API request was cancelled by the client
+	ErrorCodeCancelled ErrorCode = "cancelled"
+	// ErrorCodeInternal means that the coordinator failed
+	ErrorCodeInternal ErrorCode = "internal_error"
+)
+
+// statusCodes maps every error code to its HTTP status code
+var statusCodes = map[ErrorCode]int{
+	ErrorCodeBadRequest:       http.StatusBadRequest,
+	ErrorCodeUnknownAgent:     http.StatusNotFound,
+	ErrorCodeUnknownResource:  http.StatusNotFound,
+	ErrorCodeAgentUnreachable: http.StatusServiceUnavailable,
+	ErrorCodeAgentTimeout:     http.StatusGatewayTimeout,
+	ErrorCodeProtocolError:    http.StatusBadGateway,
+	ErrorCodeRejectedInput:    http.StatusUnprocessableEntity,
+	ErrorCodeInvalidInput:     http.StatusUnprocessableEntity,
+	ErrorCodeRejectedRequest:  http.StatusConflict,
+	ErrorCodeUnsupported:      http.StatusNotImplemented,
+	ErrorCodeAgentError:       http.StatusFailedDependency,
+	ErrorCodeTooLarge:         http.StatusRequestEntityTooLarge,
+	ErrorCodeCancelled:        http.StatusRequestTimeout,
+	ErrorCodeInternal:         http.StatusInternalServerError,
+}
+
+// Error represents an API error, as it is written to the clients
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Agent   string    `json:"agent,omitempty"`
+	// Details describes the error more precisely, for some codes
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Error returns the error description
+func (e *Error) Error() string {
+	if e.Agent == "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: agent \"%s\": %s", e.Code, e.Agent, e.Message)
+}
+
+// StatusCode returns the HTTP status code of the error
+func (e *Error) StatusCode() int {
+	if h, ok := statusCodes[e.Code]; ok {
+		return h
+	}
+	return http.StatusInternalServerError
+}
+
+// NewError creates a new API error
+func NewError(code ErrorCode, agentName string, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+		Agent:   agentName,
+	}
+}
+
+// classifyError returns the API error for a failed request to an agent
+func classifyError(agentName string, err error) *Error {
+	// I check whether the error is already an API error...
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	// ... or an error answered by the agent...
+	var agentErr *schema.AgentError
+	if errors.As(err, &agentErr) {
+		return agentError(agentName, agentErr)
+	}
+	// ... or a framing error...
+	var frameErr *schema.FrameError
+	if errors.As(err, &frameErr) {
+		// If the request did not fit in a frame, it was not sent
+		if !frameErr.Fatal && errors.Is(err, schema.ErrFrameTooLarge) {
+			return NewError(ErrorCodeTooLarge, agentName, "%v", err)
+		}
+		return NewError(ErrorCodeProtocolError, agentName, "%v", err)
+	}
+	// ... otherwise I classify it based on its cause
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return NewError(ErrorCodeAgentTimeout, agentName, "the agent did not answer in time")
+	case errors.Is(err, context.Canceled):
+		return NewError(ErrorCodeCancelled, agentName, "the request was cancelled")
+	case errors.Is(err, schema.ErrDesynced):
+		return NewError(ErrorCodeProtocolError, agentName, "%v", err)
+	}
+	return NewError(ErrorCodeAgentUnreachable, agentName, "%v", err)
+}
+
+// agentError returns the API error for an error answered by an agent
+func agentError(agentName string, err *schema.AgentError) *Error {
+	switch err.Code {
+	case schema.EndpointErrorUnsupported:
+		return NewError(ErrorCodeUnsupported, agentName, "%s", err.Message)
+	case schema.EndpointErrorInvalidPayload:
+		return NewError(ErrorCodeProtocolError, agentName, "%s", err.Message)
+	case schema.EndpointErrorRejected:
+		if err.Request == schema.EndpointMessageTypeInputREQ {
+			return NewError(ErrorCodeRejectedInput, agentName, "%s", err.Message)
+		}
+		return NewError(ErrorCodeRejectedRequest, agentName, "%s", err.Message)
+	}
+	return NewError(ErrorCodeAgentError, agentName, "%s", err.Message)
+}
+
+// errorResponse logs an API error and returns its ActionResponse
+func errorResponse(err *Error) ActionResponse {
+	log.Println(err)
+	return ActionResponse{
+		Error:      err,
+		StatusCode: err.StatusCode(),
+	}
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+
+	"github.com/abu-lang/abusim-core/abusim-coordinator/endpoint"
+
+	"github.com/gorilla/mux"
+)
+
+// agentResult represents the response of an agent to a fan-out action
+type agentResult struct {
+	Agent  string      `json:"agent"`
+	Status int         `json:"status"`
+	Result interface{} `json:"result,omitempty"`
+	Error  *Error      `json:"error,omitempty"`
+}
+
+// isFanOut checks whether a request selects several agents by means of the
+// agents, glob, all or selector query parameters
+func isFanOut(r *http.Request, rm *mux.RouteMatch) bool {
+	query := r.URL.Query()
+	for _, key := range []string{"agents", "glob", "all", "selector"} {
+		if _, ok := query[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selectAgents returns the names of the agents selected by a query: the
+// listed agents, even if unknown, and the agents matching the glob, or all
+// the agents, keeping only the unknown ones and the ones whose labels match
+// the selector
+func selectAgents(reg *endpoint.Registry, query url.Values) ([]string, *Error) {
+	// I get the selection from the query...
+	names := parseSet(query.Get("agents"))
+	glob := query.Get("glob")
+	all, ok := query["all"]
+	selectAll := ok && (len(all) == 0 || all[0] != "false")
+	selector, err := parseSelector(query.Get("selector"))
+	if err != nil {
+		return nil, NewError(ErrorCodeBadRequest, "", "%v", err)
+	}
+	if len(names) == 0 && glob == "" && !selectAll {
+		// A selector alone selects among all the agents
+		if len(selector) == 0 {
+			return nil, NewError(ErrorCodeBadRequest, "", "no agents selected, expected agents, glob, all or selector")
+		}
+		selectAll = true
+	}
+	if _, err := path.Match(glob, ""); err != nil {
+		return nil, NewError(ErrorCodeBadRequest, "", "invalid glob \"%s\": %v", glob, err)
+	}
+	// ... I add the registered agents it matches...
+	for _, agent := range reg.Agents() {
+		if selectAll {
+			names[agent.Name] = true
+			continue
+		}
+		if ok, _ := path.Match(glob, agent.Name); glob != "" && ok {
+			names[agent.Name] = true
+		}
+	}
+	// ... and I return in order the ones matching the selector, keeping
+	// the unknown ones so that they are reported
+	selected := make([]string, 0, len(names))
+	for name := range names {
+		if len(selector) > 0 {
+			agent, ok := reg.Lookup(name)
+			if ok && !selector.matches(agent.Labels()) {
+				continue
+			}
+		}
+		selected = append(selected, name)
+	}
+	sort.Strings(selected)
+	return selected, nil
+}
+
+// fanOut performs an action on the agents selected by the query of a
+// request and writes their results, reporting each failure individually
+func fanOut(w http.ResponseWriter, r *http.Request, d *Dispatcher, action Action) {
+	// I select the agents...
+	agentNames, apiErr := selectAgents(d.reg, r.URL.Query())
+	if apiErr != nil {
+		log.Println(apiErr)
+		writeError(w, apiErr)
+		return
+	}
+	// ... I perform the action on all of them...
+	responses := d.DoAll(r.Context(), agentNames, action)
+	// ... and I respond with their results
+	results := make([]agentResult, len(agentNames))
+	for i, res := range responses {
+		results[i] = agentResult{
+			Agent:  agentNames[i],
+			Status: res.StatusCode,
+			Result: res.Payload,
+			Error:  res.Error,
+		}
+		if res.Error != nil {
+			results[i].Status = res.Error.StatusCode()
+		}
+	}
+	writeResponse(w, http.StatusOK, struct {
+		Results []agentResult `json:"results"`
+	}{
+		Results: results,
+	})
+}
+
+// GetHandleMemoryAll returns an handler for the memory method on several agents
+func GetHandleMemoryAll(d *Dispatcher) http.HandlerFunc {
+	// I return the handler, decorated with the dispatcher
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I check what do I have to do
+		switch r.Method {
+		// If I need to retrieve the memories, I get the resources to select
+		// from the query and I perform a new action...
+		case http.MethodGet:
+			query := r.URL.Query()
+			payload, apiErr := memoryPayload("", query.Get("fields"), query.Get("types"))
+			if apiErr != nil {
+				log.Println(apiErr)
+				writeError(w, apiErr)
+				return
+			}
+			fanOut(w, r, d, Action{
+				Type:    ActionMemory,
+				Payload: payload,
+			})
+		// ... if I need to do an input, I parse the request body to extract
+		// the input payload and I perform a new action
+		case http.MethodPost:
+			type request struct {
+				Actions string      `json:"actions"`
+				Memory  memoryInput `json:"memory"`
+			}
+			req := request{}
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				apiErr := NewError(ErrorCodeBadRequest, "", "%v", err)
+				log.Println(apiErr)
+				writeError(w, apiErr)
+				return
+			}
+			payload, apiErr := inputPayload("", req.Actions, req.Memory)
+			if apiErr != nil {
+				log.Println(apiErr)
+				writeError(w, apiErr)
+				return
+			}
+			fanOut(w, r, d, Action{
+				Type:    ActionInput,
+				Payload: payload,
+			})
+		}
+	}
+}
+
+// GetHandleDebugAll returns an handler for the debug method on several agents
+func GetHandleDebugAll(d *Dispatcher) http.HandlerFunc {
+	// I return the handler, decorated with the dispatcher
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I check what do I have to do
+		switch r.Method {
+		// If I need to retrieve the debug states, I perform a new action...
+		case http.MethodGet:
+			fanOut(w, r, d, Action{
+				Type: ActionDebugInfo,
+			})
+		// ... if I need to change the debug status, I parse the request body
+		// to extract the status payload and I perform a new action
+		case http.MethodPost:
+			type request struct {
+				Paused    bool   `json:"paused"`
+				Verbosity string `json:"verbosity"`
+			}
+			req := request{}
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				apiErr := NewError(ErrorCodeBadRequest, "", "%v", err)
+				log.Println(apiErr)
+				writeError(w, apiErr)
+				return
+			}
+			fanOut(w, r, d, Action{
+				Type: ActionDebugSet,
+				Payload: struct {
+					paused    bool
+					verbosity string
+				}{
+					req.Paused,
+					req.Verbosity,
+				},
+			})
+		}
+	}
+}
+
+// GetHandleDebugStepAll returns an handler for the debug step method on
+// several agents
+func GetHandleDebugStepAll(d *Dispatcher) http.HandlerFunc {
+	// I return the handler, decorated with the dispatcher
+	return func(w http.ResponseWriter, r *http.Request) {
+		fanOut(w, r, d, Action{
+			Type: ActionDebugStep,
+		})
+	}
+}
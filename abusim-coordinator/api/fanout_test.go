@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/abu-lang/abusim-core/abusim-coordinator/endpoint"
+)
+
+func TestSelectAgents(t *testing.T) {
+	// I register some agents with their labels...
+	reg := endpoint.NewRegistry(endpoint.RegistryPolicyReject)
+	for name, room := range map[string]string{"temp_1": "S1", "temp_2": "S2", "light": "S1"} {
+		agent := &endpoint.Agent{Name: name}
+		agent.SetLabel("room", room)
+		reg.Register(agent)
+	}
+	// ... and I check the agents selected by every query
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"agents=light,temp_1", []string{"light", "temp_1"}},
+		{"agents=light,nosuch", []string{"light", "nosuch"}},
+		{"glob=temp_*", []string{"temp_1", "temp_2"}},
+		{"glob=temp_*&agents=light", []string{"light", "temp_1", "temp_2"}},
+		{"all", []string{"light", "temp_1", "temp_2"}},
+		{"all=false&agents=light", []string{"light"}},
+		{"selector=room=S1", []string{"light", "temp_1"}},
+		{"selector=room=S1&glob=temp_*", []string{"temp_1"}},
+		{"selector=room=S3&all", []string{}},
+		// The unknown listed agents are kept, so that they are reported
+		{"selector=room=S1&agents=temp_2,nosuch", []string{"nosuch"}},
+	}
+	for _, test := range tests {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selected, apiErr := selectAgents(reg, query)
+		if apiErr != nil {
+			t.Errorf("%s: unexpected error %v", test.query, apiErr)
+			continue
+		}
+		if !reflect.DeepEqual(selected, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, selected)
+		}
+	}
+}
+
+func TestSelectAgentsErrors(t *testing.T) {
+	reg := endpoint.NewRegistry(endpoint.RegistryPolicyReject)
+	for _, q := range []string{"", "all=false", "glob=[", "selector=room=S 1"} {
+		query, err := url.ParseQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, apiErr := selectAgents(reg, query); apiErr == nil || apiErr.Code != ErrorCodeBadRequest {
+			t.Errorf("%q: expected a bad request, got %v", q, apiErr)
+		}
+	}
+}
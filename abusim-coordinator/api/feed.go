@@ -0,0 +1,82 @@
+package api
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// debugEvent represents the debug status of an agent
+type debugEvent struct {
+	Agent     string    `json:"agent"`
+	Time      time.Time `json:"time"`
+	Paused    bool      `json:"paused"`
+	Verbosity string    `json:"verbosity"`
+}
+
+// debugSubscription represents a subscriber to the debug status changes
+type debugSubscription struct {
+	agents map[string]bool
+	ch     chan debugEvent
+}
+
+// DebugFeed distributes the changes of the debug status of the agents
+// performed through the API
+type DebugFeed struct {
+	lock          sync.Mutex
+	subscriptions map[*debugSubscription]struct{}
+}
+
+// NewDebugFeed creates a new debug feed
+func NewDebugFeed() *DebugFeed {
+	return &DebugFeed{
+		subscriptions: make(map[*debugSubscription]struct{}),
+	}
+}
+
+// Subscribe returns a channel receiving the debug status changes of the
+// specified agents, or of all agents if none is specified, and a function
+// to cancel the subscription; the channel is closed if the subscriber
+// does not keep up with the events
+func (f *DebugFeed) Subscribe(agents map[string]bool) (<-chan debugEvent, func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// I add the subscription...
+	s := &debugSubscription{
+		agents: agents,
+		ch:     make(chan debugEvent, EventBufferSize),
+	}
+	f.subscriptions[s] = struct{}{}
+	// ... and I return its channel with the cancel function
+	cancel := func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.remove(s)
+	}
+	return s.ch, cancel
+}
+
+// publish sends a debug status change to the interested subscribers
+func (f *DebugFeed) publish(event debugEvent) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for s := range f.subscriptions {
+		if len(s.agents) > 0 && !s.agents[event.Agent] {
+			continue
+		}
+		select {
+		case s.ch <- event:
+		default:
+			log.Println("Dropping a debug events subscriber that does not keep up")
+			f.remove(s)
+		}
+	}
+}
+
+// remove removes a subscription, it must be called holding the lock
+func (f *DebugFeed) remove(s *debugSubscription) {
+	if _, ok := f.subscriptions[s]; ok {
+		delete(f.subscriptions, s)
+		close(s.ch)
+	}
+}
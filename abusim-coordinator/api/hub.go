@@ -0,0 +1,364 @@
+package api
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/abu-lang/abusim-core/abusim-coordinator/endpoint"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// EventBufferSize is the number of events that a subscriber can leave
+// unread before it is dropped, besides the first snapshot of every agent
+const EventBufferSize = 64
+
+// memoryEvent represents a snapshot or a change of the memory of an agent
+type memoryEvent struct {
+	Agent    string    `json:"agent"`
+	Time     time.Time `json:"time"`
+	Snapshot bool      `json:"snapshot"`
+	Memory   resources `json:"memory"`
+}
+
+// eventFilter selects the memory events of some agents, an empty set
+// selects every agent
+type eventFilter struct {
+	agents    map[string]bool
+	resources resourceFilter
+}
+
+// matches checks whether the filter selects an agent
+func (f eventFilter) matches(agentName string) bool {
+	return len(f.agents) == 0 || f.agents[agentName]
+}
+
+// subscription represents a subscriber to the memory events
+type subscription struct {
+	filter eventFilter
+	ch     chan memoryEvent
+}
+
+// memoryWatcher observes the memory of an agent while someone is interested
+type memoryWatcher struct {
+	agent *endpoint.Agent
+	done  chan struct{}
+	// memory is the last memory observed, if known
+	memory resources
+	known  bool
+}
+
+// Hub observes the memory of the agents on behalf of all the subscribers,
+// so that every agent is polled once however many subscribers there are;
+// the agents supporting the push messages are polled only for the first
+// snapshot and when some of their changes are dropped
+type Hub struct {
+	reg      *endpoint.Registry
+	interval time.Duration
+	timeout  time.Duration
+
+	lock          sync.Mutex
+	subscriptions map[*subscription]struct{}
+	watchers      map[string]*memoryWatcher
+}
+
+// NewHub creates a new hub, polling the agents with the specified interval
+// and maximum duration of a request
+func NewHub(reg *endpoint.Registry, interval, timeout time.Duration) *Hub {
+	// I create the hub...
+	h := &Hub{
+		reg:           reg,
+		interval:      interval,
+		timeout:       timeout,
+		subscriptions: make(map[*subscription]struct{}),
+		watchers:      make(map[string]*memoryWatcher),
+	}
+	// ... and I follow the registry changes, watching the new agents that
+	// someone is interested in
+	events, _ := reg.Subscribe()
+	go func() {
+		for event := range events {
+			h.lock.Lock()
+			switch event.Type {
+			case endpoint.RegistryEventJoin:
+				if h.interested(event.Agent.Name) {
+					h.watch(event.Agent)
+				}
+			case endpoint.RegistryEventLeave:
+				h.unwatch(event.Agent)
+			}
+			h.lock.Unlock()
+		}
+	}()
+	return h
+}
+
+// Subscribe returns a channel receiving the memory events selected by the
+// filter, starting with a snapshot of every agent, and a function to
+// cancel the subscription; the channel is closed if the subscriber does
+// not keep up with the events
+func (h *Hub) Subscribe(filter eventFilter) (<-chan memoryEvent, func()) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	// I watch the agents the subscription selects, collecting the
+	// snapshots that are already known...
+	matched := 0
+	snapshots := []memoryEvent{}
+	for _, agent := range h.reg.Agents() {
+		if !filter.matches(agent.Name) {
+			continue
+		}
+		matched++
+		w, ok := h.watchers[agent.Name]
+		if !ok || w.agent != agent {
+			h.watch(agent)
+			continue
+		}
+		if w.known {
+			snapshots = append(snapshots, memoryEvent{
+				Agent:    agent.Name,
+				Time:     time.Now(),
+				Snapshot: true,
+				Memory:   w.memory,
+			})
+		}
+	}
+	// ... I add the subscription, with room for a snapshot of every agent
+	// besides the events it can leave unread...
+	s := &subscription{
+		filter: filter,
+		ch:     make(chan memoryEvent, EventBufferSize+matched),
+	}
+	h.subscriptions[s] = struct{}{}
+	// ... and I send the known snapshots
+	for _, event := range snapshots {
+		if !h.send(s, event) {
+			break
+		}
+	}
+	// Finally, I return the channel and the cancel function
+	cancel := func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		h.remove(s)
+	}
+	return s.ch, cancel
+}
+
+// Memory returns the last memory of an agent observed by the hub, which is
+// known only while someone is interested in the agent
+func (h *Hub) Memory(agent *endpoint.Agent) (schema.MemoryResources, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	w, ok := h.watchers[agent.Name]
+	if !ok || w.agent != agent || !w.known {
+		return schema.MemoryResources{}, false
+	}
+	return w.memory.toMemory(), true
+}
+
+// interested checks whether some subscription selects an agent, it must be
+// called holding the lock
+func (h *Hub) interested(agentName string) bool {
+	for s := range h.subscriptions {
+		if s.filter.matches(agentName) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch starts watching an agent, replacing the watcher of an agent with
+// the same name; it must be called holding the lock
+func (h *Hub) watch(agent *endpoint.Agent) {
+	// I check whether the agent is already watched...
+	if w, ok := h.watchers[agent.Name]; ok {
+		if w.agent == agent {
+			return
+		}
+		close(w.done)
+	}
+	// ... and, if not, I start watching it
+	w := &memoryWatcher{
+		agent: agent,
+		done:  make(chan struct{}),
+	}
+	h.watchers[agent.Name] = w
+	go h.run(w)
+}
+
+// unwatch stops watching an agent, it must be called holding the lock
+func (h *Hub) unwatch(agent *endpoint.Agent) {
+	if w, ok := h.watchers[agent.Name]; ok && w.agent == agent {
+		close(w.done)
+		delete(h.watchers, agent.Name)
+	}
+}
+
+// remove removes a subscription and stops watching the agents nobody is
+// interested in anymore, it must be called holding the lock
+func (h *Hub) remove(s *subscription) {
+	// I remove the subscription...
+	if _, ok := h.subscriptions[s]; !ok {
+		return
+	}
+	delete(h.subscriptions, s)
+	close(s.ch)
+	// ... and I stop the watchers that are not needed
+	for name, w := range h.watchers {
+		if !h.interested(name) {
+			h.unwatch(w.agent)
+		}
+	}
+}
+
+// run observes the memory of an agent, until the watcher is stopped
+func (h *Hub) run(w *memoryWatcher) {
+	// I subscribe to the memory changes, if the agent pushes them...
+	var pushes <-chan *schema.EndpointMessage
+	if schema.HasCapability(w.agent.Capabilities, schema.CapabilityPush) {
+		ch, cancel := w.agent.Mux.Subscribe(schema.EndpointMessageTypeMemoryPUSH)
+		defer cancel()
+		pushes = ch
+	}
+	// ... I take the first snapshot...
+	dropped := w.agent.Mux.DroppedPushes()
+	h.poll(w)
+	// ... and I keep observing the memory
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case msg, ok := <-pushes:
+			if !ok {
+				return
+			}
+			// If some changes were dropped, the memory is not reliable
+			// anymore, so I take a new snapshot instead
+			if w.agent.Mux.DroppedPushes() != dropped {
+				dropped = h.resnapshot(w, pushes)
+				continue
+			}
+			if payload, ok := msg.Payload.(*schema.EndpointMessagePayloadMemoryPUSH); ok {
+				h.change(w, toResources(payload.Changes))
+			}
+		case <-ticker.C:
+			// The agents pushing the changes are polled only until the
+			// first snapshot, or when some changes were dropped
+			h.lock.Lock()
+			known := w.known
+			h.lock.Unlock()
+			switch {
+			case pushes != nil && w.agent.Mux.DroppedPushes() != dropped:
+				dropped = h.resnapshot(w, pushes)
+			case pushes == nil || !known:
+				h.poll(w)
+			}
+		}
+	}
+}
+
+// poll requests the memory of an agent and emits the changes
+func (h *Hub) poll(w *memoryWatcher) {
+	// I request the memory...
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	payload, err := requestMemory(ctx, w.agent)
+	if err != nil {
+		log.Printf("Agent \"%s\" could not be polled: %v\n", w.agent.Name, err)
+		return
+	}
+	// ... and I emit the snapshot or the changes
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	memory := toResources(payload.Memory)
+	if !w.known {
+		w.memory = memory
+		w.known = true
+		h.emit(memoryEvent{
+			Agent:    w.agent.Name,
+			Time:     time.Now(),
+			Snapshot: true,
+			Memory:   memory,
+		})
+		return
+	}
+	h.update(w, memory)
+}
+
+// resnapshot takes a new snapshot of an agent whose pushed changes were
+// dropped, discarding the changes still queued since they are older than
+// the snapshot, and it returns the count of dropped changes it accounts for
+func (h *Hub) resnapshot(w *memoryWatcher, pushes <-chan *schema.EndpointMessage) int {
+	dropped := w.agent.Mux.DroppedPushes()
+	for len(pushes) > 0 {
+		<-pushes
+	}
+	h.poll(w)
+	return dropped
+}
+
+// change applies the changes pushed by an agent and emits them
+func (h *Hub) change(w *memoryWatcher, changes resources) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	// The changes are relative to the snapshot, so I need one
+	if !w.known {
+		return
+	}
+	h.update(w, w.memory.merge(changes))
+}
+
+// update replaces the memory of an agent and emits the changes, if any; it
+// must be called holding the lock
+func (h *Hub) update(w *memoryWatcher, memory resources) {
+	changes := memory.diff(w.memory)
+	w.memory = memory
+	if changes.empty() {
+		return
+	}
+	h.emit(memoryEvent{
+		Agent:  w.agent.Name,
+		Time:   time.Now(),
+		Memory: changes,
+	})
+}
+
+// emit sends an event to the subscribers selecting it, it must be called
+// holding the lock
+func (h *Hub) emit(event memoryEvent) {
+	for s := range h.subscriptions {
+		if s.filter.matches(event.Agent) {
+			h.send(s, event)
+		}
+	}
+}
+
+// send sends an event to a subscriber, filtering its resources and
+// dropping the subscriber if it does not keep up, and it returns whether
+// the subscriber is still subscribed; it must be called holding the lock
+func (h *Hub) send(s *subscription, event memoryEvent) bool {
+	// I check that the subscriber was not dropped...
+	if _, ok := h.subscriptions[s]; !ok {
+		return false
+	}
+	// ... I filter the resources, skipping the changes that are not
+	// selected...
+	event.Memory = s.filter.resources.apply(event.Memory)
+	if !event.Snapshot && event.Memory.empty() {
+		return true
+	}
+	// ... and I send the event
+	select {
+	case s.ch <- event:
+		return true
+	default:
+		log.Println("Dropping a memory events subscriber that does not keep up")
+		h.remove(s)
+		return false
+	}
+}
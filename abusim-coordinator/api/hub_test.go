@@ -0,0 +1,147 @@
+package api
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abu-lang/abusim-core/abusim-coordinator/endpoint"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// pushAgent represents an agent pushing the changes of its temperature
+type pushAgent struct {
+	end         *schema.Endpoint
+	lock        sync.Mutex
+	temperature int64
+}
+
+// newPushAgent registers an agent pushing its memory changes, which answers
+// the memory requests with its current temperature
+func newPushAgent(t *testing.T, reg *endpoint.Registry) (*pushAgent, *endpoint.Agent) {
+	t.Helper()
+	a, b := net.Pipe()
+	agent := &endpoint.Agent{
+		Name:         "sensor",
+		Capabilities: []string{schema.CapabilityPush},
+		Mux:          schema.NewMultiplexer(schema.New(a)),
+	}
+	p := &pushAgent{end: schema.New(b)}
+	t.Cleanup(func() {
+		agent.Mux.Close()
+		b.Close()
+	})
+	go func() {
+		for {
+			msg, err := p.end.Read()
+			if err != nil {
+				return
+			}
+			if msg.Type != schema.EndpointMessageTypeMemoryREQ {
+				continue
+			}
+			p.lock.Lock()
+			memory := schema.MemoryResources{Integer: map[string]int64{"temperature": p.temperature}}
+			p.lock.Unlock()
+			p.end.Write(&schema.EndpointMessage{
+				ID:      msg.ID,
+				Type:    schema.EndpointMessageTypeMemoryRES,
+				Payload: &schema.EndpointMessagePayloadMemoryRES{Memory: memory},
+			})
+		}
+	}()
+	reg.Register(agent)
+	return p, agent
+}
+
+// set changes the temperature and pushes the change
+func (p *pushAgent) set(t *testing.T, temperature int64) {
+	t.Helper()
+	p.lock.Lock()
+	p.temperature = temperature
+	p.lock.Unlock()
+	err := p.end.Write(&schema.EndpointMessage{
+		Type: schema.EndpointMessageTypeMemoryPUSH,
+		Payload: &schema.EndpointMessagePayloadMemoryPUSH{
+			Time:    time.Now(),
+			Changes: schema.MemoryResources{Integer: map[string]int64{"temperature": temperature}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitTemperature waits until the hub observes a temperature
+func waitTemperature(t *testing.T, h *Hub, agent *endpoint.Agent, expected int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		memory, ok := h.Memory(agent)
+		if ok && memory.Integer["temperature"] == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected temperature %d, got %v (known %v)", expected, memory.Integer, ok)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHubPushes(t *testing.T) {
+	reg := endpoint.NewRegistry(endpoint.RegistryPolicyReject)
+	h := NewHub(reg, time.Hour, time.Second)
+	p, agent := newPushAgent(t, reg)
+	events, cancel := h.Subscribe(eventFilter{})
+	defer cancel()
+	// The hub takes the first snapshot...
+	waitTemperature(t, h, agent, 0)
+	// ... and then follows the pushed changes
+	p.set(t, 1)
+	waitTemperature(t, h, agent, 1)
+	for _, expected := range []bool{true, false} {
+		select {
+		case event := <-events:
+			if event.Snapshot != expected {
+				t.Fatalf("expected snapshot %v, got %+v", expected, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected a memory event")
+		}
+	}
+}
+
+func TestHubDroppedPushes(t *testing.T) {
+	reg := endpoint.NewRegistry(endpoint.RegistryPolicyReject)
+	h := NewHub(reg, time.Hour, time.Second)
+	p, agent := newPushAgent(t, reg)
+	events, cancel := h.Subscribe(eventFilter{})
+	defer cancel()
+	go func() {
+		for range events {
+		}
+	}()
+	waitTemperature(t, h, agent, 0)
+	// I keep the hub busy, so that the pushed changes are dropped...
+	h.lock.Lock()
+	for i := int64(1); i <= 2*schema.PushBufferSize; i++ {
+		p.set(t, i)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for agent.Mux.DroppedPushes() == 0 {
+		if time.Now().After(deadline) {
+			h.lock.Unlock()
+			t.Fatal("expected some pushed changes to be dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	h.lock.Unlock()
+	// ... and, once the next change arrives, the hub takes a new snapshot
+	// instead of applying the changes left
+	p.set(t, 1000)
+	waitTemperature(t, h, agent, 1000)
+	time.Sleep(50 * time.Millisecond)
+	waitTemperature(t, h, agent, 1000)
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// memoryInput represents a structured input, with the new values of some
+// resources grouped by type as in MemoryResources
+type memoryInput map[string]map[string]json.RawMessage
+
+// resourceInput represents the new value of a single resource, whose type
+// is the one of the resource in the memory unless specified
+type resourceInput struct {
+	name  string
+	typ   string
+	value json.RawMessage
+}
+
+// inputProblem represents a value of a structured input that does not
+// match the memory of the agent
+type inputProblem struct {
+	Type     string `json:"type"`
+	Resource string `json:"resource"`
+	Message  string `json:"message"`
+}
+
+// inputPayload returns the payload of an input action, either the actions
+// or the structured input, which cannot be both specified
+func inputPayload(agentName, actions string, memory memoryInput) (interface{}, *Error) {
+	// If there is no structured input, the payload is the actions...
+	if memory == nil {
+		return actions, nil
+	}
+	// ... otherwise I check that it is the only input and that it is not empty
+	if actions != "" {
+		return nil, NewError(ErrorCodeBadRequest, agentName, "expected either actions or memory, not both")
+	}
+	for _, values := range memory {
+		if len(values) > 0 {
+			return memory, nil
+		}
+	}
+	return nil, NewError(ErrorCodeBadRequest, agentName, "the memory input has no resources")
+}
+
+// render checks the structured input against the memory of an agent and
+// returns the equivalent actions, or the problems of the values that do
+// not match the type of their resource
+func (in memoryInput) render(memory schema.MemoryResources) (string, []inputProblem) {
+	current := toResources(memory)
+	assignments := []string{}
+	problems := []inputProblem{}
+	// I render the values in order of type...
+	for _, t := range in.types() {
+		// ... and of name...
+		names := make([]string, 0, len(in[t]))
+		for name := range in[t] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// ... checking that the type exists...
+			if !hasString(resourceTypes, t) {
+				problems = append(problems, inputProblem{t, name, fmt.Sprintf("unknown resource type, expected one of %s", strings.Join(resourceTypes, ", "))})
+				continue
+			}
+			// ... that the resource exists with that type...
+			if _, ok := current[t][name]; !ok {
+				message := "unknown resource"
+				for _, other := range resourceTypes {
+					if _, ok := current[other][name]; ok {
+						message = fmt.Sprintf("the resource has type %s", other)
+					}
+				}
+				problems = append(problems, inputProblem{t, name, message})
+				continue
+			}
+			// ... and that the value has the same type
+			literal, err := renderValue(t, in[t][name])
+			if err != nil {
+				problems = append(problems, inputProblem{t, name, err.Error()})
+				continue
+			}
+			assignments = append(assignments, name+" = "+literal)
+		}
+	}
+	return strings.Join(assignments, "; "), problems
+}
+
+// types returns the types of the input in the order of MemoryResources,
+// followed by the unknown ones
+func (in memoryInput) types() []string {
+	types := []string{}
+	for _, t := range resourceTypes {
+		if _, ok := in[t]; ok {
+			types = append(types, t)
+		}
+	}
+	unknown := []string{}
+	for t := range in {
+		if !hasString(resourceTypes, t) {
+			unknown = append(unknown, t)
+		}
+	}
+	sort.Strings(unknown)
+	return append(types, unknown...)
+}
+
+// renderValue converts a JSON value to the literal of a resource type,
+// quoting and escaping the texts and the times
+func renderValue(t string, raw json.RawMessage) (string, error) {
+	// I refuse the missing values...
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		article := "a"
+		if t == "integer" {
+			article = "an"
+		}
+		return "", fmt.Errorf("expected %s %s value, found null", article, t)
+	}
+	// ... and I check the value based on the type
+	switch t {
+	case "bool":
+		var b bool
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return "", fmt.Errorf("expected a bool value, found %s", raw)
+		}
+		return strconv.FormatBool(b), nil
+	case "integer":
+		// A JSON number can also be decoded from a string, which I refuse
+		var n json.Number
+		if err := json.Unmarshal(raw, &n); err != nil || bytes.HasPrefix(bytes.TrimSpace(raw), []byte(`"`)) {
+			return "", fmt.Errorf("expected an integer value, found %s", raw)
+		}
+		i, err := strconv.ParseInt(n.String(), 10, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			return "", fmt.Errorf("expected a 64 bits integer value, found %s", raw)
+		}
+		if err != nil {
+			return "", fmt.Errorf("expected an integer value, found %s", raw)
+		}
+		return strconv.FormatInt(i, 10), nil
+	case "float":
+		var f float64
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return "", fmt.Errorf("expected a float value, found %s", raw)
+		}
+		// The floats always have a decimal point, so that they are not
+		// taken for integers
+		literal := strconv.FormatFloat(f, 'f', -1, 64)
+		if !strings.Contains(literal, ".") {
+			literal += ".0"
+		}
+		return literal, nil
+	case "text":
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", fmt.Errorf("expected a text value, found %s", raw)
+		}
+		return strconv.Quote(s), nil
+	case "time":
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", fmt.Errorf("expected a time value in RFC 3339 format, found %s", raw)
+		}
+		tm, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return "", fmt.Errorf("expected a time value in RFC 3339 format, found %s", raw)
+		}
+		return strconv.Quote(tm.Format(time.RFC3339Nano)), nil
+	}
+	return "", fmt.Errorf("unknown resource type")
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/abu-lang/abusim-core/abusim-coordinator/actions"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+func TestRenderValue(t *testing.T) {
+	tests := []struct {
+		typ      string
+		raw      string
+		expected string
+	}{
+		{"bool", `true`, `true`},
+		{"bool", `false`, `false`},
+		{"integer", `-42`, `-42`},
+		{"integer", `9223372036854775807`, `9223372036854775807`},
+		{"float", `5`, `5.0`},
+		{"float", `-0.25`, `-0.25`},
+		{"float", `1e-7`, `0.0000001`},
+		{"float", `1e21`, `1000000000000000000000.0`},
+		{"text", `""`, `""`},
+		{"text", `"say \"hi\""`, `"say \"hi\""`},
+		{"text", `"C:\\dir"`, `"C:\\dir"`},
+		{"text", `"two\nlines\ttab"`, `"two\nlines\ttab"`},
+		{"text", `"città"`, `"città"`},
+		{"time", `"2026-10-17T09:30:00Z"`, `"2026-10-17T09:30:00Z"`},
+		{"time", `"2026-10-17T09:30:00.5+02:00"`, `"2026-10-17T09:30:00.5+02:00"`},
+	}
+	for _, test := range tests {
+		literal, err := renderValue(test.typ, json.RawMessage(test.raw))
+		if err != nil {
+			t.Errorf("%s %s: unexpected error %v", test.typ, test.raw, err)
+			continue
+		}
+		if literal != test.expected {
+			t.Errorf("%s %s: expected %s, got %s", test.typ, test.raw, test.expected, literal)
+		}
+	}
+}
+
+func TestRenderValueErrors(t *testing.T) {
+	tests := []struct {
+		typ     string
+		raw     string
+		message string
+	}{
+		{"bool", `null`, "expected a bool value, found null"},
+		{"bool", `"true"`, `expected a bool value, found "true"`},
+		{"bool", `1`, "expected a bool value, found 1"},
+		{"integer", `null`, "expected an integer value, found null"},
+		{"integer", `"5"`, `expected an integer value, found "5"`},
+		{"integer", `5.5`, "expected an integer value, found 5.5"},
+		{"integer", `5e2`, "expected an integer value, found 5e2"},
+		{"integer", `9223372036854775808`, "expected a 64 bits integer value, found 9223372036854775808"},
+		{"integer", `-9223372036854775809`, "expected a 64 bits integer value, found -9223372036854775809"},
+		{"float", `"1.5"`, `expected a float value, found "1.5"`},
+		{"float", `1e999`, "expected a float value, found 1e999"},
+		{"text", `5`, "expected a text value, found 5"},
+		{"text", ` null `, "expected a text value, found null"},
+		{"time", `"yesterday"`, `expected a time value in RFC 3339 format, found "yesterday"`},
+		{"time", `"2026-10-17 09:30:00"`, `expected a time value in RFC 3339 format, found "2026-10-17 09:30:00"`},
+		{"time", `0`, "expected a time value in RFC 3339 format, found 0"},
+		{"color", `"red"`, "unknown resource type"},
+	}
+	for _, test := range tests {
+		_, err := renderValue(test.typ, json.RawMessage(test.raw))
+		if err == nil || err.Error() != test.message {
+			t.Errorf("%s %s: expected %q, got %v", test.typ, test.raw, test.message, err)
+		}
+	}
+}
+
+// inputMemory returns a memory with some resources of every type
+func inputMemory() schema.MemoryResources {
+	return schema.MemoryResources{
+		Bool:    map[string]bool{"on": false},
+		Integer: map[string]int64{"temperature": 20, "count": 0},
+		Float:   map[string]float64{"humidity": 0.5},
+		Text:    map[string]string{"label": ""},
+		Time:    map[string]time.Time{"since": time.Now()},
+	}
+}
+
+// parseInput decodes a structured input from its JSON
+func parseInput(t *testing.T, s string) memoryInput {
+	t.Helper()
+	in := memoryInput{}
+	if err := json.Unmarshal([]byte(s), &in); err != nil {
+		t.Fatal(err)
+	}
+	return in
+}
+
+func TestMemoryInputRender(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"integer": {"temperature": 5}}`, `temperature = 5`},
+		{`{"float": {"humidity": 1}}`, `humidity = 1.0`},
+		{`{"text": {"label": "say \"hi\"\\\n"}}`, `label = "say \"hi\"\\\n"`},
+		// The resources are rendered in order of type and of name
+		{
+			`{"time": {"since": "2026-10-17T09:30:00Z"}, "text": {"label": "x"}, "integer": {"temperature": 5, "count": 1}, "bool": {"on": true}}`,
+			`on = true; count = 1; temperature = 5; label = "x"; since = "2026-10-17T09:30:00Z"`,
+		},
+	}
+	for _, test := range tests {
+		rendered, problems := parseInput(t, test.input).render(inputMemory())
+		if len(problems) != 0 {
+			t.Errorf("%s: unexpected problems %+v", test.input, problems)
+			continue
+		}
+		if rendered != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.input, test.expected, rendered)
+		}
+	}
+}
+
+func TestMemoryInputProblems(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []inputProblem
+	}{
+		{`{"integer": {"nosuch": 1}}`, []inputProblem{{"integer", "nosuch", "unknown resource"}}},
+		{`{"float": {"temperature": 1.5}}`, []inputProblem{{"float", "temperature", "the resource has type integer"}}},
+		{`{"text": {"on": "true"}}`, []inputProblem{{"text", "on", "the resource has type bool"}}},
+		{`{"integer": {"temperature": null}}`, []inputProblem{{"integer", "temperature", "expected an integer value, found null"}}},
+		{`{"time": {"since": "2026-13-01T00:00:00Z"}}`, []inputProblem{{"time", "since", `expected a time value in RFC 3339 format, found "2026-13-01T00:00:00Z"`}}},
+		{`{"color": {"on": "red"}}`, []inputProblem{{"color", "on", "unknown resource type, expected one of bool, integer, float, text, time"}}},
+		// Every problem is reported at once
+		{`{"integer": {"temperature": "5", "count": 2.5}, "bool": {"on": 1}}`, []inputProblem{
+			{"bool", "on", "expected a bool value, found 1"},
+			{"integer", "count", "expected an integer value, found 2.5"},
+			{"integer", "temperature", `expected an integer value, found "5"`},
+		}},
+	}
+	for _, test := range tests {
+		_, problems := parseInput(t, test.input).render(inputMemory())
+		if !reflect.DeepEqual(problems, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.input, test.expected, problems)
+		}
+	}
+}
+
+func TestRenderedActionsParse(t *testing.T) {
+	// Every rendered value is parsed back by the actions parser as the same
+	// value, with the type of its resource
+	tests := []struct {
+		typ      string
+		raw      string
+		expected interface{}
+	}{
+		{"bool", `true`, true},
+		{"integer", `-9223372036854775808`, int64(-9223372036854775808)},
+		{"float", `5`, 5.0},
+		{"float", `1e-7`, 1e-7},
+		{"float", `123456789.125`, 123456789.125},
+		{"text", `"say \"hi\""`, "say \"hi\""},
+		{"text", `"back\\slash"`, "back\\slash"},
+		{"text", `"new\nline\r\u0000"`, "new\nline\r\x00"},
+		{"text", `"emoji 😀 and \u00e8"`, "emoji 😀 and è"},
+		{"time", `"2026-10-17T09:30:00.123456789-07:00"`, "2026-10-17T09:30:00.123456789-07:00"},
+	}
+	names := map[string]string{"bool": "on", "integer": "temperature", "float": "humidity", "text": "label", "time": "since"}
+	for _, test := range tests {
+		in := memoryInput{test.typ: {names[test.typ]: json.RawMessage(test.raw)}}
+		rendered, problems := in.render(inputMemory())
+		if len(problems) != 0 {
+			t.Errorf("%s %s: unexpected problems %+v", test.typ, test.raw, problems)
+			continue
+		}
+		assignments, diagnostics := actions.Lint(rendered, inputMemory())
+		if len(diagnostics) != 0 || len(assignments) != 1 {
+			t.Errorf("%s %s: %s not accepted: %v", test.typ, test.raw, rendered, diagnostics)
+			continue
+		}
+		if got := assignments[0].Value.Value; got != test.expected {
+			t.Errorf("%s %s: %s parsed as %#v, expected %#v", test.typ, test.raw, rendered, got, test.expected)
+		}
+	}
+}
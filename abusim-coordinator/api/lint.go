@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/abu-lang/abusim-core/abusim-coordinator/actions"
+)
+
+// invalidActions returns the API error for actions with some diagnostics
+func invalidActions(agentName string, diagnostics []actions.Diagnostic) *Error {
+	// I describe the first problem...
+	apiErr := NewError(ErrorCodeInvalidInput, agentName, "%s", diagnostics[0])
+	if len(diagnostics) > 1 {
+		apiErr.Message += " (and more)"
+	}
+	// ... and I list all of them in the details
+	apiErr.Details = diagnostics
+	return apiErr
+}
+
+// GetHandleLint returns an handler for the actions linting method
+func GetHandleLint(d *Dispatcher) http.HandlerFunc {
+	// I return the handler, decorated with the dispatcher
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I parse the request body to extract the actions and the agent
+		// whose memory they are checked against, if any...
+		type request struct {
+			Actions string `json:"actions"`
+			Agent   string `json:"agent"`
+		}
+		req := request{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiErr := NewError(ErrorCodeBadRequest, "", "%v", err)
+			log.Println(apiErr)
+			writeError(w, apiErr)
+			return
+		}
+		// ... I check the syntax...
+		_, diagnostics := actions.Parse(req.Actions)
+		// ... and, if there is an agent, I check the assignments against
+		// its memory
+		if req.Agent != "" {
+			agent, ok := d.reg.Lookup(req.Agent)
+			if !ok {
+				apiErr := NewError(ErrorCodeUnknownAgent, req.Agent, "unknown agent")
+				log.Println(apiErr)
+				writeError(w, apiErr)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), d.timeout)
+			defer cancel()
+			state, err := requestMemory(ctx, agent)
+			if err != nil {
+				apiErr := classifyError(req.Agent, err)
+				log.Println(apiErr)
+				writeError(w, apiErr)
+				return
+			}
+			_, diagnostics = actions.Lint(req.Actions, state.Memory)
+		}
+		// Finally, I respond with the diagnostics
+		writeResponse(w, http.StatusOK, struct {
+			Valid       bool                 `json:"valid"`
+			Diagnostics []actions.Diagnostic `json:"diagnostics"`
+		}{
+			Valid:       len(diagnostics) == 0,
+			Diagnostics: append([]actions.Diagnostic{}, diagnostics...),
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// resourceTypes lists the names of the resource types, as in MemoryResources
+var resourceTypes = []string{"bool", "integer", "float", "text", "time"}
+
+// resources maps every resource type to the values of its resources
+type resources map[string]map[string]interface{}
+
+// toResources converts the memory of an agent to resources
+func toResources(m schema.MemoryResources) resources {
+	// I create a map for every type...
+	r := resources{}
+	for _, t := range resourceTypes {
+		r[t] = map[string]interface{}{}
+	}
+	// ... and I fill them
+	for name, value := range m.Bool {
+		r["bool"][name] = value
+	}
+	for name, value := range m.Integer {
+		r["integer"][name] = value
+	}
+	for name, value := range m.Float {
+		r["float"][name] = value
+	}
+	for name, value := range m.Text {
+		r["text"][name] = value
+	}
+	for name, value := range m.Time {
+		r["time"][name] = value
+	}
+	return r
+}
+
+// toMemory converts resources back to the memory of an agent
+func (r resources) toMemory() schema.MemoryResources {
+	// I create a map for every type...
+	m := schema.MemoryResources{
+		Bool:    map[string]bool{},
+		Integer: map[string]int64{},
+		Float:   map[string]float64{},
+		Text:    map[string]string{},
+		Time:    map[string]time.Time{},
+	}
+	// ... and I fill them
+	for name, value := range r["bool"] {
+		m.Bool[name], _ = value.(bool)
+	}
+	for name, value := range r["integer"] {
+		m.Integer[name], _ = value.(int64)
+	}
+	for name, value := range r["float"] {
+		m.Float[name], _ = value.(float64)
+	}
+	for name, value := range r["text"] {
+		m.Text[name], _ = value.(string)
+	}
+	for name, value := range r["time"] {
+		m.Time[name], _ = value.(time.Time)
+	}
+	return m
+}
+
+// diff returns the resources whose value is new or different from the
+// previous resources
+func (r resources) diff(previous resources) resources {
+	d := resources{}
+	for t, values := range r {
+		for name, value := range values {
+			old, ok := previous[t][name]
+			if ok && sameValue(old, value) {
+				continue
+			}
+			if d[t] == nil {
+				d[t] = map[string]interface{}{}
+			}
+			d[t][name] = value
+		}
+	}
+	return d
+}
+
+// merge returns new resources with the changes applied
+func (r resources) merge(changes resources) resources {
+	m := resources{}
+	for _, src := range []resources{r, changes} {
+		for t, values := range src {
+			if m[t] == nil {
+				m[t] = map[string]interface{}{}
+			}
+			for name, value := range values {
+				m[t][name] = value
+			}
+		}
+	}
+	return m
+}
+
+// empty checks whether there are no resources
+func (r resources) empty() bool {
+	for _, values := range r {
+		if len(values) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sameValue checks whether two resource values are equal
+func sameValue(a, b interface{}) bool {
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	}
+	return a == b
+}
+
+// resourceFilter selects some resources by name and type, an empty set
+// selects everything
+type resourceFilter struct {
+	names map[string]bool
+	types map[string]bool
+}
+
+// parseResourceFilter creates a filter from the comma separated lists of
+// resource names and types, checking that the types exist
+func parseResourceFilter(names, types string) (resourceFilter, error) {
+	f := resourceFilter{
+		names: parseSet(names),
+		types: parseSet(types),
+	}
+	for t := range f.types {
+		if !hasString(resourceTypes, t) {
+			return f, fmt.Errorf("unknown resource type \"%s\", expected one of %s", t, strings.Join(resourceTypes, ", "))
+		}
+	}
+	return f, nil
+}
+
+// apply returns the resources selected by the filter
+func (f resourceFilter) apply(r resources) resources {
+	selected := resources{}
+	for t, values := range r {
+		if len(f.types) > 0 && !f.types[t] {
+			continue
+		}
+		for name, value := range values {
+			if len(f.names) > 0 && !f.names[name] {
+				continue
+			}
+			if selected[t] == nil {
+				selected[t] = map[string]interface{}{}
+			}
+			selected[t][name] = value
+		}
+	}
+	return selected
+}
+
+// memoryPayload returns the payload of a memory action from the fields and
+// types lists of a query, that is nil if there is no filter
+func memoryPayload(agentName, fields, types string) (interface{}, *Error) {
+	if fields == "" && types == "" {
+		return nil, nil
+	}
+	filter, err := parseResourceFilter(fields, types)
+	if err != nil {
+		return nil, NewError(ErrorCodeBadRequest, agentName, "%v", err)
+	}
+	return filter, nil
+}
+
+// selects checks whether the filter selects a resource
+func (f resourceFilter) selects(t, name string) bool {
+	return (len(f.types) == 0 || f.types[t]) && (len(f.names) == 0 || f.names[name])
+}
+
+// applyMemory returns the memory of an agent with only the resources
+// selected by the filter, keeping an empty map for every type
+func (f resourceFilter) applyMemory(m schema.MemoryResources) schema.MemoryResources {
+	// I create a map for every type...
+	selected := schema.MemoryResources{
+		Bool:    map[string]bool{},
+		Integer: map[string]int64{},
+		Float:   map[string]float64{},
+		Text:    map[string]string{},
+		Time:    map[string]time.Time{},
+	}
+	// ... and I fill them with the selected resources
+	for name, value := range m.Bool {
+		if f.selects("bool", name) {
+			selected.Bool[name] = value
+		}
+	}
+	for name, value := range m.Integer {
+		if f.selects("integer", name) {
+			selected.Integer[name] = value
+		}
+	}
+	for name, value := range m.Float {
+		if f.selects("float", name) {
+			selected.Float[name] = value
+		}
+	}
+	for name, value := range m.Text {
+		if f.selects("text", name) {
+			selected.Text[name] = value
+		}
+	}
+	for name, value := range m.Time {
+		if f.selects("time", name) {
+			selected.Time[name] = value
+		}
+	}
+	return selected
+}
+
+// findResource returns the type and the value of a resource of the memory
+func findResource(m schema.MemoryResources, name string) (string, interface{}, bool) {
+	r := toResources(m)
+	for _, t := range resourceTypes {
+		if value, ok := r[t][name]; ok {
+			return t, value, true
+		}
+	}
+	return "", nil, false
+}
+
+// parseSet parses a comma separated list into a set, ignoring the empty items
+func parseSet(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// hasString checks whether a string is in a list
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
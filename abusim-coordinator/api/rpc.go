@@ -0,0 +1,469 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// rpcVersion is the JSON-RPC version of the control API
+const rpcVersion = "2.0"
+
+// rpcWriteTimeout is the maximum duration of a write to a client
+const rpcWriteTimeout = 10 * time.Second
+
+// The JSON-RPC error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	// rpcAPIError means that the command failed with the API error in the data
+	rpcAPIError = -32000
+)
+
+// rpcRequest represents a command, or a notification if it has no ID
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// rpcParams represents the parameters of all the commands
+type rpcParams struct {
+	Agent        string      `json:"agent"`
+	Actions      string      `json:"actions"`
+	Memory       memoryInput `json:"memory"`
+	Paused       bool        `json:"paused"`
+	Verbosity    string      `json:"verbosity"`
+	Agents       []string    `json:"agents"`
+	Resources    []string    `json:"resources"`
+	Types        []string    `json:"types"`
+	Subscription string      `json:"subscription"`
+}
+
+// rpcError represents the error of a failed command
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// rpcResponse represents the response to a command
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// rpcNotification represents a message sent without a command
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// rpcConn represents a client of the control API
+type rpcConn struct {
+	ws *websocket.Conn
+	d  *Dispatcher
+	h  *Hub
+	// ctx is cancelled when the connection is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wlock sync.Mutex
+
+	lock          sync.Mutex
+	nextID        int
+	subscriptions map[string]func()
+}
+
+// GetHandleRPC returns an handler for the WebSocket control API, which
+// accepts JSON-RPC commands mirroring the REST methods and subscriptions
+// to the memory and debug status changes
+func GetHandleRPC(d *Dispatcher, h *Hub) http.HandlerFunc {
+	// I create an upgrader respecting the CORS origins...
+	upgrader := websocket.Upgrader{
+		CheckOrigin: originAllowed,
+	}
+	// ... and I return the handler, decorated with the dispatcher and the hub
+	return func(w http.ResponseWriter, r *http.Request) {
+		// I upgrade the connection...
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		// ... and I serve its commands, until it is closed
+		ctx, cancel := context.WithCancel(context.Background())
+		c := &rpcConn{
+			ws:            ws,
+			d:             d,
+			h:             h,
+			ctx:           ctx,
+			cancel:        cancel,
+			subscriptions: make(map[string]func()),
+		}
+		defer c.close()
+		c.serve()
+	}
+}
+
+// originAllowed checks whether the origin of a request is one of the CORS
+// allowed origins; requests without origin do not come from a browser
+func originAllowed(r *http.Request) bool {
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		allowed = strings.ToLower(allowed)
+		// I match the origins with a wildcard like the CORS middleware...
+		if i := strings.Index(allowed, "*"); i >= 0 {
+			prefix, suffix := allowed[:i], allowed[i+1:]
+			if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+			continue
+		}
+		// ... and the others exactly
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// serve reads the commands and performs each of them concurrently
+func (c *rpcConn) serve() {
+	for {
+		// I read a command...
+		_, b, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		req := rpcRequest{}
+		err = json.Unmarshal(b, &req)
+		if err != nil {
+			c.reply(json.RawMessage("null"), nil, &rpcError{
+				Code:    rpcParseError,
+				Message: err.Error(),
+			})
+			continue
+		}
+		if req.JSONRPC != rpcVersion || req.Method == "" {
+			c.reply(req.ID, nil, &rpcError{
+				Code:    rpcInvalidRequest,
+				Message: "expected a JSON-RPC 2.0 request with a method",
+			})
+			continue
+		}
+		// ... and I perform it
+		go c.handle(req)
+	}
+}
+
+// handle performs a command and replies
+func (c *rpcConn) handle(req rpcRequest) {
+	// I parse the parameters...
+	params := rpcParams{}
+	if len(req.Params) > 0 {
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			c.reply(req.ID, nil, &rpcError{
+				Code:    rpcInvalidParams,
+				Message: err.Error(),
+			})
+			return
+		}
+	}
+	// ... and I perform the correct procedure based on the method
+	switch req.Method {
+	case "config.get":
+		c.do(req, params, Action{Type: ActionConfig})
+	case "memory.get":
+		payload, apiErr := memoryPayload(params.Agent, strings.Join(params.Resources, ","), strings.Join(params.Types, ","))
+		if apiErr != nil {
+			c.reply(req.ID, nil, &rpcError{
+				Code:    rpcInvalidParams,
+				Message: apiErr.Message,
+			})
+			return
+		}
+		c.do(req, params, Action{Type: ActionMemory, Payload: payload})
+	case "memory.input":
+		payload, apiErr := inputPayload(params.Agent, params.Actions, params.Memory)
+		if apiErr != nil {
+			c.reply(req.ID, nil, &rpcError{
+				Code:    rpcInvalidParams,
+				Message: apiErr.Message,
+			})
+			return
+		}
+		c.do(req, params, Action{Type: ActionInput, Payload: payload})
+	case "debug.get":
+		c.do(req, params, Action{Type: ActionDebugInfo})
+	case "debug.set":
+		c.do(req, params, Action{
+			Type: ActionDebugSet,
+			Payload: struct {
+				paused    bool
+				verbosity string
+			}{
+				params.Paused,
+				params.Verbosity,
+			},
+		})
+	case "debug.step":
+		c.do(req, params, Action{Type: ActionDebugStep})
+	case "memory.subscribe":
+		c.subscribeMemory(req, params)
+	case "debug.subscribe":
+		c.subscribeDebug(req, params)
+	case "unsubscribe":
+		c.unsubscribe(req, params)
+	default:
+		c.reply(req.ID, nil, &rpcError{
+			Code:    rpcMethodNotFound,
+			Message: "unknown method \"" + req.Method + "\"",
+		})
+	}
+}
+
+// do performs an action on the agent of the parameters and replies with
+// its response
+func (c *rpcConn) do(req rpcRequest, params rpcParams, action Action) {
+	// I check the agent...
+	if params.Agent == "" {
+		c.reply(req.ID, nil, &rpcError{
+			Code:    rpcInvalidParams,
+			Message: "missing agent",
+		})
+		return
+	}
+	// ... I perform the action...
+	action.AgentName = params.Agent
+	res := c.d.Do(c.ctx, action)
+	// ... and I reply with its response
+	if res.Error != nil {
+		c.reply(req.ID, nil, &rpcError{
+			Code:    rpcAPIError,
+			Message: res.Error.Message,
+			Data:    res.Error,
+		})
+		return
+	}
+	c.reply(req.ID, res.Payload, nil)
+}
+
+// subscribeMemory subscribes to the memory changes selected by the parameters
+func (c *rpcConn) subscribeMemory(req rpcRequest, params rpcParams) {
+	// I create the filter...
+	resources, err := parseResourceFilter(strings.Join(params.Resources, ","), strings.Join(params.Types, ","))
+	if err != nil {
+		c.reply(req.ID, nil, &rpcError{
+			Code:    rpcInvalidParams,
+			Message: err.Error(),
+		})
+		return
+	}
+	// ... I subscribe...
+	events, cancel := c.h.Subscribe(eventFilter{
+		agents:    parseSet(strings.Join(params.Agents, ",")),
+		resources: resources,
+	})
+	id, ok := c.addSubscription(cancel)
+	if !ok {
+		return
+	}
+	c.reply(req.ID, struct {
+		Subscription string `json:"subscription"`
+	}{id}, nil)
+	// ... and I forward the events
+	go func() {
+		for event := range events {
+			c.notify("memory", struct {
+				Subscription string `json:"subscription"`
+				memoryEvent
+			}{id, event})
+		}
+		c.endSubscription(id)
+	}()
+}
+
+// subscribeDebug subscribes to the debug status changes of the agents of
+// the parameters, starting with their current status
+func (c *rpcConn) subscribeDebug(req rpcRequest, params rpcParams) {
+	// I subscribe...
+	agents := parseSet(strings.Join(params.Agents, ","))
+	events, cancel := c.d.DebugFeed().Subscribe(agents)
+	id, ok := c.addSubscription(cancel)
+	if !ok {
+		return
+	}
+	c.reply(req.ID, struct {
+		Subscription string `json:"subscription"`
+	}{id}, nil)
+	go func() {
+		// ... I send the current status of every agent...
+		for _, agent := range c.d.reg.Agents() {
+			if len(agents) > 0 && !agents[agent.Name] {
+				continue
+			}
+			event, err := c.debugStatus(agent.Name)
+			if err != nil {
+				log.Printf("Agent \"%s\" debug status not available: %v\n", agent.Name, err)
+				continue
+			}
+			c.notify("debug", struct {
+				Subscription string `json:"subscription"`
+				debugEvent
+			}{id, event})
+		}
+		// ... and I forward the changes
+		for event := range events {
+			c.notify("debug", struct {
+				Subscription string `json:"subscription"`
+				debugEvent
+			}{id, event})
+		}
+		c.endSubscription(id)
+	}()
+}
+
+// debugStatus requests the debug status of an agent
+func (c *rpcConn) debugStatus(agentName string) (debugEvent, error) {
+	// I look for the agent...
+	agent, ok := c.d.reg.Lookup(agentName)
+	if !ok {
+		return debugEvent{}, NewError(ErrorCodeUnknownAgent, agentName, "unknown agent")
+	}
+	// ... I request its status...
+	ctx, cancel := context.WithTimeout(c.ctx, c.d.timeout)
+	defer cancel()
+	status, err := requestDebugStatus(ctx, agent)
+	if err != nil {
+		return debugEvent{}, err
+	}
+	// ... and I return it
+	return debugEvent{
+		Agent:     agentName,
+		Time:      time.Now(),
+		Paused:    status.Paused,
+		Verbosity: status.Verbosity,
+	}, nil
+}
+
+// unsubscribe cancels the subscription of the parameters
+func (c *rpcConn) unsubscribe(req rpcRequest, params rpcParams) {
+	// I remove the subscription...
+	c.lock.Lock()
+	cancel, ok := c.subscriptions[params.Subscription]
+	delete(c.subscriptions, params.Subscription)
+	c.lock.Unlock()
+	if !ok {
+		c.reply(req.ID, nil, &rpcError{
+			Code:    rpcInvalidParams,
+			Message: "unknown subscription \"" + params.Subscription + "\"",
+		})
+		return
+	}
+	// ... and I cancel it
+	cancel()
+	c.reply(req.ID, "ok", nil)
+}
+
+// addSubscription keeps track of a subscription and returns its ID, or it
+// cancels the subscription if the connection is already closed
+func (c *rpcConn) addSubscription(cancel func()) (string, bool) {
+	// I add the subscription, unless the connection is closed...
+	c.lock.Lock()
+	closed := c.ctx.Err() != nil
+	id := ""
+	if !closed {
+		c.nextID++
+		id = strconv.Itoa(c.nextID)
+		c.subscriptions[id] = cancel
+	}
+	c.lock.Unlock()
+	// ... otherwise I cancel it outside the lock
+	if closed {
+		cancel()
+		return "", false
+	}
+	return id, true
+}
+
+// endSubscription removes a subscription whose events ended, telling the
+// client if it did not cancel it
+func (c *rpcConn) endSubscription(id string) {
+	c.lock.Lock()
+	_, ok := c.subscriptions[id]
+	delete(c.subscriptions, id)
+	c.lock.Unlock()
+	if ok {
+		c.notify("unsubscribed", struct {
+			Subscription string `json:"subscription"`
+		}{id})
+	}
+}
+
+// reply replies to a command, unless it is a notification
+func (c *rpcConn) reply(id json.RawMessage, result interface{}, err *rpcError) {
+	if len(id) == 0 {
+		return
+	}
+	c.write(rpcResponse{
+		JSONRPC: rpcVersion,
+		ID:      id,
+		Result:  result,
+		Error:   err,
+	})
+}
+
+// notify sends a notification
+func (c *rpcConn) notify(method string, params interface{}) {
+	c.write(rpcNotification{
+		JSONRPC: rpcVersion,
+		Method:  method,
+		Params:  params,
+	})
+}
+
+// write writes a message, closing the connection if it fails
+func (c *rpcConn) write(v interface{}) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(rpcWriteTimeout))
+	err := c.ws.WriteJSON(v)
+	if err != nil {
+		log.Println(err)
+		c.ws.Close()
+	}
+}
+
+// close cancels all the subscriptions and closes the connection
+func (c *rpcConn) close() {
+	// I cancel the context and the subscriptions, so that no new one is
+	// added by the commands still running...
+	c.lock.Lock()
+	c.cancel()
+	subscriptions := c.subscriptions
+	c.subscriptions = make(map[string]func())
+	c.lock.Unlock()
+	for _, cancel := range subscriptions {
+		cancel()
+	}
+	// ... and I close the connection
+	c.ws.Close()
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/abu-lang/abusim-core/abusim-coordinator/endpoint"
+)
+
+func TestRPCSubscriptionAfterClose(t *testing.T) {
+	h := NewHub(endpoint.NewRegistry(endpoint.RegistryPolicyReject), time.Hour, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &rpcConn{
+		h:             h,
+		ctx:           ctx,
+		cancel:        cancel,
+		subscriptions: make(map[string]func()),
+	}
+	// A subscription is kept while the connection is open...
+	_, unsubscribe := h.Subscribe(eventFilter{})
+	if _, ok := c.addSubscription(unsubscribe); !ok {
+		t.Fatal("expected the subscription to be added")
+	}
+	// ... but a command still running when the connection is closed
+	// cannot add one
+	cancel()
+	events, unsubscribe := h.Subscribe(eventFilter{})
+	if _, ok := c.addSubscription(unsubscribe); ok {
+		t.Fatal("expected the subscription to be refused")
+	}
+	if _, ok := <-events; ok {
+		t.Fatal("expected the subscription to be cancelled")
+	}
+	if len(c.subscriptions) != 1 {
+		t.Fatalf("expected one subscription, got %d", len(c.subscriptions))
+	}
+}
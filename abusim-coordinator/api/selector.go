@@ -0,0 +1,157 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// selectorOperator represents the operator of a label requirement
+type selectorOperator int
+
+const (
+	selectorEquals       selectorOperator = iota
+	selectorNotEquals    selectorOperator = iota
+	selectorIn           selectorOperator = iota
+	selectorNotIn        selectorOperator = iota
+	selectorExists       selectorOperator = iota
+	selectorDoesNotExist selectorOperator = iota
+)
+
+// labelRequirement represents a condition on a label of an agent
+type labelRequirement struct {
+	key      string
+	operator selectorOperator
+	values   []string
+}
+
+// labelSelector selects the agents whose labels satisfy all the
+// requirements, an empty selector selects every agent
+type labelSelector []labelRequirement
+
+// setRequirement matches the set based requirements, such as room in (S1,S2)
+var setRequirement = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+
+// parseSelector parses a label selector with the syntax of Kubernetes, that
+// is a comma separated list of requirements among key=value, key==value,
+// key!=value, key in (v1,v2), key notin (v1,v2), key and !key
+func parseSelector(s string) (labelSelector, error) {
+	selector := labelSelector{}
+	for _, part := range splitRequirements(s) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r, err := parseRequirement(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector \"%s\": %w", s, err)
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+// splitRequirements splits a selector on the commas outside the parentheses
+func splitRequirements(s string) []string {
+	parts := []string{}
+	depth := 0
+	start := 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseRequirement parses a single requirement of a selector
+func parseRequirement(s string) (labelRequirement, error) {
+	// I check whether the requirement is on the existence of the label...
+	r := labelRequirement{}
+	if strings.HasPrefix(s, "!") {
+		r.key = strings.TrimSpace(s[1:])
+		r.operator = selectorDoesNotExist
+		return r, schema.ValidateLabelKey(r.key)
+	}
+	// ... or on a set of values...
+	if m := setRequirement.FindStringSubmatch(s); m != nil {
+		r.key = m[1]
+		r.operator = selectorIn
+		if m[2] == "notin" {
+			r.operator = selectorNotIn
+		}
+		for _, value := range strings.Split(m[3], ",") {
+			r.values = append(r.values, strings.TrimSpace(value))
+		}
+		return r, r.validate()
+	}
+	// ... or on a single value...
+	for _, op := range []struct {
+		token    string
+		operator selectorOperator
+	}{
+		{"!=", selectorNotEquals},
+		{"==", selectorEquals},
+		{"=", selectorEquals},
+	} {
+		if i := strings.Index(s, op.token); i >= 0 {
+			r.key = strings.TrimSpace(s[:i])
+			r.operator = op.operator
+			r.values = []string{strings.TrimSpace(s[i+len(op.token):])}
+			return r, r.validate()
+		}
+	}
+	// ... otherwise it requires the label to exist
+	r.key = s
+	r.operator = selectorExists
+	return r, r.validate()
+}
+
+// validate checks the key and the values of a requirement
+func (r labelRequirement) validate() error {
+	if err := schema.ValidateLabelKey(r.key); err != nil {
+		return err
+	}
+	for _, value := range r.values {
+		if err := schema.ValidateLabelValue(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches checks whether some labels satisfy the requirement
+func (r labelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.operator {
+	case selectorEquals, selectorIn:
+		return ok && hasString(r.values, value)
+	case selectorNotEquals, selectorNotIn:
+		return !ok || !hasString(r.values, value)
+	case selectorExists:
+		return ok
+	case selectorDoesNotExist:
+		return !ok
+	}
+	return false
+}
+
+// matches checks whether some labels satisfy all the requirements
+func (s labelSelector) matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
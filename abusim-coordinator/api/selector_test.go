@@ -0,0 +1,103 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		expected labelSelector
+	}{
+		{"", labelSelector{}},
+		{" , ", labelSelector{}},
+		{"room=S1", labelSelector{{"room", selectorEquals, []string{"S1"}}}},
+		{"room == S1", labelSelector{{"room", selectorEquals, []string{"S1"}}}},
+		{"room!=S1", labelSelector{{"room", selectorNotEquals, []string{"S1"}}}},
+		{"room=", labelSelector{{"room", selectorEquals, []string{""}}}},
+		{"room in (S1, S2)", labelSelector{{"room", selectorIn, []string{"S1", "S2"}}}},
+		{"room notin (S1,S2)", labelSelector{{"room", selectorNotIn, []string{"S1", "S2"}}}},
+		{"example.com/room", labelSelector{{"example.com/room", selectorExists, nil}}},
+		{"!room", labelSelector{{"room", selectorDoesNotExist, nil}}},
+		{"room in (S1,S2), kind=sensor, !broken", labelSelector{
+			{"room", selectorIn, []string{"S1", "S2"}},
+			{"kind", selectorEquals, []string{"sensor"}},
+			{"broken", selectorDoesNotExist, nil},
+		}},
+	}
+	for _, test := range tests {
+		selector, err := parseSelector(test.selector)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.selector, err)
+			continue
+		}
+		if !reflect.DeepEqual(selector, test.expected) {
+			t.Errorf("%q: expected %v, got %v", test.selector, test.expected, selector)
+		}
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	tests := []string{
+		"=S1",
+		"room=S 1",
+		"room in (S1,-S2)",
+		"!",
+		"!-room",
+		"/room",
+		"example..com/room",
+		"room=S1, =sensor",
+	}
+	for _, selector := range tests {
+		if _, err := parseSelector(selector); err == nil {
+			t.Errorf("%q: expected an error", selector)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"room": "S1", "kind": "sensor", "example.com/floor": "1"}
+	tests := []struct {
+		selector string
+		matches  bool
+	}{
+		{"", true},
+		{"room=S1", true},
+		{"room=S2", false},
+		{"room!=S2", true},
+		{"room!=S1", false},
+		{"missing!=S1", true},
+		{"room in (S1,S2)", true},
+		{"room in (S2,S3)", false},
+		{"missing in (S1)", false},
+		{"room notin (S2,S3)", true},
+		{"room notin (S1,S2)", false},
+		{"missing notin (S1)", true},
+		{"example.com/floor", true},
+		{"missing", false},
+		{"!missing", true},
+		{"!room", false},
+		{"room=S1, kind=sensor", true},
+		{"room=S1, kind=actuator", false},
+		{"room=", false},
+	}
+	for _, test := range tests {
+		selector, err := parseSelector(test.selector)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.selector, err)
+			continue
+		}
+		if got := selector.matches(labels); got != test.matches {
+			t.Errorf("%q: expected %v, got %v", test.selector, test.matches, got)
+		}
+	}
+	// An empty value matches the agents with the label set to it
+	selector, err := parseSelector("room=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !selector.matches(map[string]string{"room": ""}) {
+		t.Error("expected an empty value to match")
+	}
+}
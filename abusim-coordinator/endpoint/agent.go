@@ -0,0 +1,120 @@
+package endpoint
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// AgentState represents the liveness state of an agent
+type AgentState int
+
+const (
+	AgentStateConnected AgentState = iota
+	AgentStateSuspect   AgentState = iota
+	AgentStateDead      AgentState = iota
+)
+
+// String returns the name of the state
+func (s AgentState) String() string {
+	switch s {
+	case AgentStateConnected:
+		return "connected"
+	case AgentStateSuspect:
+		return "suspect"
+	case AgentStateDead:
+		return "dead"
+	}
+	return fmt.Sprintf("unknown state %d", int(s))
+}
+
+// Agent represents a connected agent
+type Agent struct {
+	Name         string
+	RemoteAddr   string
+	ConnectedAt  time.Time
+	Version      int
+	Capabilities []string
+	Codec        string
+	Compression  string
+	Mux          *schema.Multiplexer
+
+	lock   sync.Mutex
+	state  AgentState
+	labels map[string]string
+}
+
+// State returns the liveness state of the agent
+func (a *Agent) State() AgentState {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.state
+}
+
+// setState changes the liveness state of the agent, returning the previous one
+func (a *Agent) setState(state AgentState) AgentState {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	previous := a.state
+	a.state = state
+	return previous
+}
+
+// Labels returns a copy of the labels of the agent
+func (a *Agent) Labels() map[string]string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	labels := make(map[string]string, len(a.labels))
+	for key, value := range a.labels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// SetLabel adds a label to the agent, replacing the value of the same key
+func (a *Agent) SetLabel(key, value string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.labels == nil {
+		a.labels = make(map[string]string)
+	}
+	a.labels[key] = value
+}
+
+// RemoveLabel removes a label from the agent, returning whether it had it
+func (a *Agent) RemoveLabel(key string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, ok := a.labels[key]
+	delete(a.labels, key)
+	return ok
+}
+
+// LastSeen returns the last time the agent sent something
+func (a *Agent) LastSeen() time.Time {
+	// I check when the agent sent the last message...
+	lastSeen := a.Mux.LastReceived()
+	// ... and, if it never did, I use the connection time
+	if lastSeen.IsZero() {
+		return a.ConnectedAt
+	}
+	return lastSeen
+}
+
+// FrameErrors returns how many frames exchanged with the agent could not be
+// read or written, and the last error
+func (a *Agent) FrameErrors() (int, error) {
+	return a.Mux.Endpoint().FrameErrors()
+}
+
+// Stats returns the traffic exchanged with the agent
+func (a *Agent) Stats() schema.EndpointStats {
+	return a.Mux.Endpoint().Stats()
+}
+
+// Close closes the connection to the agent
+func (a *Agent) Close() {
+	a.Mux.Close()
+}
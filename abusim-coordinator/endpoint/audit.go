@@ -0,0 +1,65 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry represents a rejected join attempt
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remoteaddr"`
+	Name       string    `json:"name,omitempty"`
+	Reason     string    `json:"reason"`
+	Message    string    `json:"message"`
+}
+
+// AuditLog records the rejected join attempts, one JSON object per line
+type AuditLog struct {
+	lock sync.Mutex
+	w    io.WriteCloser
+}
+
+// OpenAuditLog opens an audit log, appending to the specified file
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{
+		w: f,
+	}, nil
+}
+
+// Record records a rejected join attempt, it does nothing on a nil log
+func (a *AuditLog) Record(entry AuditEntry) {
+	if a == nil {
+		return
+	}
+	// I encode the entry...
+	entry.Time = time.Now()
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// ... and I write it as a single line
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, err = a.w.Write(append(b, '\n'))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Close closes the audit log
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.w.Close()
+}
@@ -0,0 +1,53 @@
+package endpoint
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// challenge authenticates an agent, asking it to prove that it knows the
+// shared secret
+func challenge(end *schema.Endpoint, secret []byte, name string) error {
+	// I generate a nonce...
+	nonce := make([]byte, schema.NonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	// ... I send the challenge, giving up if it is not read in time...
+	err = writeHandshake(end, &schema.EndpointMessage{
+		Type: schema.EndpointMessageTypeCHALLENGE,
+		Payload: &schema.EndpointMessagePayloadCHALLENGE{
+			Nonce: nonce,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// ... I wait for the answer, giving up if it does not arrive in time...
+	err = end.SetReadDeadline(time.Now().Add(schema.HandshakeTimeout))
+	if err != nil {
+		return err
+	}
+	msg, err := end.Read()
+	if err != nil {
+		return err
+	}
+	err = end.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	// ... and I check it
+	auth, ok := msg.Payload.(*schema.EndpointMessagePayloadAUTH)
+	if msg.Type != schema.EndpointMessageTypeAUTH || !ok {
+		return fmt.Errorf("expected an authentication message, got type %d", msg.Type)
+	}
+	if !schema.VerifyMAC(secret, nonce, name, auth.MAC) {
+		return errors.New("wrong answer to the challenge")
+	}
+	return nil
+}
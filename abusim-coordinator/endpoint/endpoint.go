@@ -1,58 +1,209 @@
 package endpoint
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"github.com/abu-lang/abusim-core/schema"
 )
 
-// GetListener returns a listener on the control port
-func GetListener() net.Listener {
-	// I create a TCP listener on the specified port...
-	listener, err := net.Listen("tcp4", ":5001")
-	if err != nil {
-		log.Fatalln(err)
-	}
-	// ... and I return it
-	return listener
+// Config represents the configuration of the agents connections
+type Config struct {
+	// MaxFrameSize is the maximum size of a frame body in bytes
+	MaxFrameSize int
+	// Compression enables the frame compression with the agents supporting it
+	Compression bool
+	// CompressionThreshold is the size in bytes from which the messages are compressed
+	CompressionThreshold int
+	// Secret is the shared secret that the agents must prove to know, no
+	// authentication is required if it is empty
+	Secret []byte
+	// Audit records the rejected join attempts, if not nil
+	Audit *AuditLog
+	// Heartbeat is the configuration of the agents liveness tracking
+	Heartbeat HeartbeatConfig
 }
 
-// HandleConnections handles the incoming connections from agents
-func HandleConnections(listener net.Listener, ends map[string]*schema.Endpoint) {
+// HandleConnections handles the incoming connections from agents with the
+// specified configuration
+func HandleConnections(listener net.Listener, reg *Registry, cfg Config) {
 	// I loop...
 	for {
 		// ... I accept an incoming connection...
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 		// ... and I handle it
-		go handleConnection(conn, ends)
+		go handleConnection(conn, reg, cfg)
 	}
 }
 
 // handleConnection handles a single incoming connection
-func handleConnection(conn net.Conn, ends map[string]*schema.Endpoint) {
+func handleConnection(conn net.Conn, reg *Registry, cfg Config) {
 	log.Printf("New agent connected from %s\n", conn.RemoteAddr().String())
 	// I create a new endpoint...
 	end := schema.New(conn)
-	// ... I receive the initialization message...
+	if cfg.MaxFrameSize > 0 {
+		end.SetMaxFrameSize(cfg.MaxFrameSize)
+	}
+	end.SetCompressionThreshold(cfg.CompressionThreshold)
+	// ... I receive the initialization message, giving up if it does not arrive in time...
+	err := end.SetReadDeadline(time.Now().Add(schema.HandshakeTimeout))
+	if err != nil {
+		log.Println(err)
+		end.Close()
+		return
+	}
 	initMsg, err := end.Read()
+	if err != nil {
+		log.Printf("Connection from %s dropped: %v\n", conn.RemoteAddr().String(), err)
+		cfg.Audit.Record(AuditEntry{
+			RemoteAddr: conn.RemoteAddr().String(),
+			Reason:     "handshake failed",
+			Message:    err.Error(),
+		})
+		end.Close()
+		return
+	}
+	err = end.SetReadDeadline(time.Time{})
 	if err != nil {
 		log.Println(err)
+		end.Close()
+		return
+	}
+	// ... I check that it is valid...
+	initPayload, ok := initMsg.Payload.(*schema.EndpointMessagePayloadINIT)
+	if initMsg.Type != schema.EndpointMessageTypeINIT || !ok || initPayload.Name == "" {
+		reject(end, cfg.Audit, "", schema.EndpointAckReasonInvalidInit, "expected an initialization message with a name")
+		return
+	}
+	// ... I check its labels...
+	if err := schema.ValidateLabels(initPayload.Labels); err != nil {
+		reject(end, cfg.Audit, initPayload.Name, schema.EndpointAckReasonInvalidInit, err.Error())
+		return
+	}
+	// ... I check that it matches the client certificate, if any...
+	if identities, ok := peerIdentities(conn); ok && !matchesIdentity(identities, initPayload.Name) {
+		reject(end, cfg.Audit, initPayload.Name, schema.EndpointAckReasonIdentityMismatch, fmt.Sprintf("agent \"%s\" does not match the certificate identities %v", initPayload.Name, identities))
+		return
+	}
+	// ... I check the protocol version...
+	if initPayload.Version != schema.ProtocolVersion {
+		reject(end, cfg.Audit, initPayload.Name, schema.EndpointAckReasonVersionMismatch, fmt.Sprintf("agent \"%s\" uses version %d, coordinator uses version %d", initPayload.Name, initPayload.Version, schema.ProtocolVersion))
 		return
 	}
-	// ... and I acknowledge it
-	err = end.Write(&schema.EndpointMessage{
-		Type:    schema.EndpointMessageTypeACK,
-		Payload: nil,
+	// ... I authenticate it, if needed...
+	if len(cfg.Secret) > 0 {
+		err = challenge(end, cfg.Secret, initPayload.Name)
+		if err != nil {
+			reject(end, cfg.Audit, initPayload.Name, schema.EndpointAckReasonAuthFailed, err.Error())
+			return
+		}
+	}
+	// ... I negotiate the capabilities...
+	capabilities := schema.NegotiateCapabilities(initPayload.Capabilities)
+	for _, c := range schema.RequiredCapabilities {
+		if !schema.HasCapability(capabilities, c) {
+			reject(end, cfg.Audit, initPayload.Name, schema.EndpointAckReasonMissingCapability, fmt.Sprintf("agent \"%s\" does not support \"%s\"", initPayload.Name, c))
+			return
+		}
+	}
+	end.SetCapabilities(capabilities)
+	// ... I negotiate the codec...
+	codec := schema.NegotiateCodec(initPayload.Codecs)
+	// ... and the compression, if enabled...
+	compression := ""
+	if cfg.Compression {
+		compression = schema.NegotiateCompression(initPayload.Compressions)
+	}
+	// ... I reserve a name for the agent...
+	name, err := reg.Reserve(initPayload.Name)
+	if err != nil {
+		reject(end, cfg.Audit, initPayload.Name, schema.EndpointAckReasonNameTaken, err.Error())
+		return
+	}
+	// ... I acknowledge it, giving up if it does not read the
+	// acknowledgement in time...
+	end.SetName(name)
+	err = writeHandshake(end, &schema.EndpointMessage{
+		Type: schema.EndpointMessageTypeACK,
+		Payload: &schema.EndpointMessagePayloadACK{
+			Reason:       schema.EndpointAckReasonAccepted,
+			Name:         name,
+			Version:      schema.ProtocolVersion,
+			Capabilities: capabilities,
+			Codec:        codec.Name(),
+			Compression:  compression,
+		},
 	})
 	if err != nil {
 		log.Println(err)
+		reg.Release(name)
+		end.Close()
 		return
 	}
-	// Finally, I add the endpoint to the endpoints pool
-	ends[initMsg.Payload.(*schema.EndpointMessagePayloadINIT).Name] = end
+	// ... I switch to the negotiated codec and compression...
+	end.SetCodec(codec)
+	end.SetCompression(compression)
+	// ... I add the agent to the registry...
+	agent := &Agent{
+		Name:         name,
+		RemoteAddr:   conn.RemoteAddr().String(),
+		ConnectedAt:  time.Now(),
+		Version:      initPayload.Version,
+		Capabilities: capabilities,
+		Codec:        codec.Name(),
+		Compression:  compression,
+		Mux:          schema.NewMultiplexer(end),
+		labels:       initPayload.Labels,
+	}
+	reg.Register(agent)
+	log.Printf("Agent \"%s\" accepted with capabilities %v, codec %s and compression \"%s\"\n", agent.Name, capabilities, agent.Codec, agent.Compression)
+	// ... I log the lines it pushes...
+	go logPushes(agent)
+	// ... and I track its liveness
+	go heartbeat(agent, reg, cfg.Heartbeat)
+}
+
+// reject rejects an agent, explaining the reason in the acknowledgement
+// and recording it in the audit log
+func reject(end *schema.Endpoint, audit *AuditLog, name string, reason schema.EndpointAckReason, message string) {
+	log.Printf("Agent rejected: %s: %s\n", reason, message)
+	audit.Record(AuditEntry{
+		RemoteAddr: end.RemoteAddr().String(),
+		Name:       name,
+		Reason:     reason.String(),
+		Message:    message,
+	})
+	// I send the negative acknowledgement...
+	err := writeHandshake(end, &schema.EndpointMessage{
+		Type: schema.EndpointMessageTypeACK,
+		Payload: &schema.EndpointMessagePayloadACK{
+			Reason:  reason,
+			Message: message,
+			Version: schema.ProtocolVersion,
+		},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	// ... and I close the connection
+	end.Close()
+}
+
+// writeHandshake sends a message of the handshake, failing if the agent
+// does not read it in time
+func writeHandshake(end *schema.Endpoint, msg *schema.EndpointMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), schema.HandshakeTimeout)
+	defer cancel()
+	return end.WriteContext(ctx, msg)
 }
@@ -0,0 +1,92 @@
+package endpoint
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// HeartbeatConfig represents the configuration of the agents liveness tracking
+type HeartbeatConfig struct {
+	// Interval is the time between two heartbeats
+	Interval time.Duration
+	// Timeout is the time after which an unanswered heartbeat makes the agent suspect
+	Timeout time.Duration
+	// DeadAfter is the time without contact after which the agent is dead
+	DeadAfter time.Duration
+}
+
+// heartbeat tracks the liveness of an agent, until it is dead
+func heartbeat(agent *Agent, reg *Registry, cfg HeartbeatConfig) {
+	// I create a ticker for the heartbeats...
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	// ... I keep track of the frame errors already reported...
+	frameErrors := 0
+	// ... and I loop
+	for {
+		select {
+		// If the connection failed, the agent is dead...
+		case <-agent.Mux.Done():
+			log.Printf("Agent \"%s\" disconnected: %v\n", agent.Name, agent.Mux.Err())
+			drop(agent, reg)
+			return
+		// ... otherwise I check on it
+		case <-ticker.C:
+			// I report the new frame errors, if any...
+			if n, err := agent.FrameErrors(); n > frameErrors {
+				log.Printf("Agent \"%s\" has %d new frame errors, the last one: %v\n", agent.Name, n-frameErrors, err)
+				frameErrors = n
+			}
+			// ... if the agent does not support heartbeats, I only notice disconnections...
+			if !schema.HasCapability(agent.Capabilities, schema.CapabilityHeartbeat) {
+				continue
+			}
+			// ... otherwise I send one
+			ping(agent, cfg.Timeout)
+			// If the agent has not been seen for too long, it is dead...
+			if time.Since(agent.LastSeen()) > cfg.DeadAfter {
+				log.Printf("Agent \"%s\" not seen for %s\n", agent.Name, cfg.DeadAfter)
+				drop(agent, reg)
+				return
+			}
+			// ... otherwise it is suspect if it did not answer the last heartbeat
+			state := AgentStateConnected
+			if time.Since(agent.LastSeen()) > cfg.Interval+cfg.Timeout {
+				state = AgentStateSuspect
+			}
+			if previous := agent.setState(state); previous != state {
+				log.Printf("Agent \"%s\" is now %s\n", agent.Name, state)
+			}
+		}
+	}
+}
+
+// ping sends a heartbeat to an agent and waits for the answer
+func ping(agent *Agent, timeout time.Duration) {
+	// I create a context for the timeout...
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// ... and I send the heartbeat
+	_, err := agent.Mux.Request(ctx, &schema.EndpointMessage{
+		Type:    schema.EndpointMessageTypePING,
+		Payload: nil,
+	})
+	if err != nil {
+		log.Printf("Agent \"%s\" did not answer the heartbeat: %v\n", agent.Name, err)
+	}
+}
+
+// drop marks an agent as dead, closes it and removes it from the registry
+func drop(agent *Agent, reg *Registry) {
+	// I mark the agent as dead...
+	agent.setState(AgentStateDead)
+	// ... I close its connection...
+	agent.Close()
+	// ... and I remove it, if it was not replaced in the meantime
+	if reg.Unregister(agent) {
+		log.Printf("Agent \"%s\" removed\n", agent.Name)
+	}
+}
@@ -0,0 +1,20 @@
+package endpoint
+
+import (
+	"log"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// logPushes logs the log lines pushed by an agent, until it disconnects
+func logPushes(agent *Agent) {
+	// I subscribe to the log lines...
+	msgs, cancel := agent.Mux.Subscribe(schema.EndpointMessageTypeLogPUSH)
+	defer cancel()
+	// ... and I log them as they arrive
+	for msg := range msgs {
+		if payload, ok := msg.Payload.(*schema.EndpointMessagePayloadLogPUSH); ok {
+			log.Printf("Agent \"%s\" [%s]: %s\n", agent.Name, payload.Level, payload.Message)
+		}
+	}
+}
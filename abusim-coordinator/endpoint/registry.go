@@ -0,0 +1,233 @@
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrNameTaken is returned when an agent name is already registered
+var ErrNameTaken = errors.New("agent name already taken")
+
+// RegistryPolicy represents how the registry handles a new agent with the
+// same name of a registered one
+type RegistryPolicy int
+
+const (
+	// RegistryPolicyReject rejects the new agent
+	RegistryPolicyReject RegistryPolicy = iota
+	// RegistryPolicyReplace closes the registered agent and replaces it
+	RegistryPolicyReplace RegistryPolicy = iota
+	// RegistryPolicySuffix registers the new agent with a numeric suffix
+	RegistryPolicySuffix RegistryPolicy = iota
+)
+
+// ParseRegistryPolicy returns the policy with the specified name
+func ParseRegistryPolicy(name string) (RegistryPolicy, error) {
+	switch name {
+	case "reject":
+		return RegistryPolicyReject, nil
+	case "replace":
+		return RegistryPolicyReplace, nil
+	case "suffix":
+		return RegistryPolicySuffix, nil
+	}
+	return 0, fmt.Errorf("unknown registry policy \"%s\"", name)
+}
+
+// RegistryEventType represents a type of registry event
+type RegistryEventType int
+
+const (
+	RegistryEventJoin  RegistryEventType = iota
+	RegistryEventLeave RegistryEventType = iota
+)
+
+// RegistryEvent represents an agent joining or leaving the registry
+type RegistryEvent struct {
+	Type  RegistryEventType
+	Agent *Agent
+}
+
+// subscriber represents a receiver of registry events
+type subscriber struct {
+	events chan RegistryEvent
+	done   chan struct{}
+}
+
+// Registry represents the set of connected agents, it is safe to use it
+// from several goroutines
+type Registry struct {
+	policy   RegistryPolicy
+	lock     sync.RWMutex
+	agents   map[string]*Agent
+	reserved map[string]struct{}
+	// slock serializes the publication of the events, so that the
+	// subscribers receive them in the same order of the changes
+	slock       sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+// NewRegistry creates a new registry with the specified policy
+func NewRegistry(policy RegistryPolicy) *Registry {
+	return &Registry{
+		policy:      policy,
+		agents:      make(map[string]*Agent),
+		reserved:    make(map[string]struct{}),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Reserve reserves a name for a connecting agent, applying the registry
+// policy if it is taken, and it returns the reserved name, which differs
+// from the requested one with the suffix policy
+func (r *Registry) Reserve(name string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// I check if the name is taken...
+	_, registered := r.agents[name]
+	_, reserved := r.reserved[name]
+	if registered || reserved {
+		// ... and, if it is, I apply the policy
+		switch r.policy {
+		case RegistryPolicyReject:
+			return "", fmt.Errorf("%w: \"%s\"", ErrNameTaken, name)
+		case RegistryPolicyReplace:
+			// A registered agent is replaced on registration, but two
+			// agents cannot connect with the same name at the same time
+			if reserved {
+				return "", fmt.Errorf("%w: \"%s\" is connecting", ErrNameTaken, name)
+			}
+		case RegistryPolicySuffix:
+			base := name
+			for i := 2; registered || reserved; i++ {
+				name = fmt.Sprintf("%s-%d", base, i)
+				_, registered = r.agents[name]
+				_, reserved = r.reserved[name]
+			}
+		}
+	}
+	// I reserve the name
+	r.reserved[name] = struct{}{}
+	return name, nil
+}
+
+// Release releases a reserved name that will not be registered
+func (r *Registry) Release(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.reserved, name)
+}
+
+// Register adds an agent to the registry with the name it reserved,
+// replacing and closing the agent registered with the same name, if any
+func (r *Registry) Register(agent *Agent) {
+	r.lock.Lock()
+	events := []RegistryEvent{}
+	// I release the reservation...
+	delete(r.reserved, agent.Name)
+	// ... I replace the old agent, if there is one...
+	if old, ok := r.agents[agent.Name]; ok {
+		old.Close()
+		events = append(events, RegistryEvent{
+			Type:  RegistryEventLeave,
+			Agent: old,
+		})
+	}
+	// ... I add the agent...
+	r.agents[agent.Name] = agent
+	events = append(events, RegistryEvent{
+		Type:  RegistryEventJoin,
+		Agent: agent,
+	})
+	// ... and I publish the events
+	r.publish(events)
+}
+
+// Unregister removes an agent from the registry, if it was not replaced in
+// the meantime, and it returns whether it was removed
+func (r *Registry) Unregister(agent *Agent) bool {
+	r.lock.Lock()
+	// I check that the agent is the registered one...
+	if r.agents[agent.Name] != agent {
+		r.lock.Unlock()
+		return false
+	}
+	// ... I remove it...
+	delete(r.agents, agent.Name)
+	// ... and I publish the event
+	r.publish([]RegistryEvent{{
+		Type:  RegistryEventLeave,
+		Agent: agent,
+	}})
+	return true
+}
+
+// Lookup returns an agent, given its name
+func (r *Registry) Lookup(name string) (*Agent, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	agent, ok := r.agents[name]
+	return agent, ok
+}
+
+// Agents returns all the registered agents, sorted by name
+func (r *Registry) Agents() []*Agent {
+	// I copy the agents...
+	r.lock.RLock()
+	agents := make([]*Agent, 0, len(r.agents))
+	for _, agent := range r.agents {
+		agents = append(agents, agent)
+	}
+	r.lock.RUnlock()
+	// ... and I sort them
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].Name < agents[j].Name
+	})
+	return agents
+}
+
+// Subscribe returns a channel receiving the future registry events and a
+// function to cancel the subscription; the channel must be drained until
+// the cancellation, since the events are never dropped
+func (r *Registry) Subscribe() (<-chan RegistryEvent, func()) {
+	// I create the subscriber...
+	s := &subscriber{
+		events: make(chan RegistryEvent, 16),
+		done:   make(chan struct{}),
+	}
+	// ... I add it...
+	r.slock.Lock()
+	r.subscribers[s] = struct{}{}
+	r.slock.Unlock()
+	// ... and I return it with its cancellation
+	once := sync.Once{}
+	return s.events, func() {
+		once.Do(func() {
+			close(s.done)
+			r.slock.Lock()
+			delete(r.subscribers, s)
+			r.slock.Unlock()
+		})
+	}
+}
+
+// publish sends the events to the subscribers, it must be called holding
+// the registry lock, which it releases
+func (r *Registry) publish(events []RegistryEvent) {
+	// I take the publication lock before releasing the registry lock,
+	// so that the changes and the events have the same order...
+	r.slock.Lock()
+	defer r.slock.Unlock()
+	r.lock.Unlock()
+	// ... and I send the events
+	for _, event := range events {
+		for s := range r.subscribers {
+			select {
+			case s.events <- event:
+			case <-s.done:
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package endpoint
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// testAgent creates an agent with the specified name, connected to nobody
+func testAgent(t *testing.T, name string) *Agent {
+	a, b := net.Pipe()
+	agent := &Agent{
+		Name: name,
+		Mux:  schema.NewMultiplexer(schema.New(a)),
+	}
+	t.Cleanup(func() {
+		agent.Close()
+		b.Close()
+	})
+	return agent
+}
+
+// registryView follows the events of a registry, keeping the agents that
+// the events say are registered
+type registryView struct {
+	lock   sync.Mutex
+	agents map[string]*Agent
+	err    error
+}
+
+// follow keeps the view up to date with the events, until they stop
+func (v *registryView) follow(events <-chan RegistryEvent) {
+	for event := range events {
+		v.lock.Lock()
+		switch event.Type {
+		case RegistryEventJoin:
+			if _, ok := v.agents[event.Agent.Name]; ok && v.err == nil {
+				v.err = errors.New("agent \"" + event.Agent.Name + "\" joined before the previous one left")
+			}
+			v.agents[event.Agent.Name] = event.Agent
+		case RegistryEventLeave:
+			if v.agents[event.Agent.Name] != event.Agent && v.err == nil {
+				v.err = errors.New("agent \"" + event.Agent.Name + "\" left without joining")
+			}
+			delete(v.agents, event.Agent.Name)
+		}
+		v.lock.Unlock()
+	}
+}
+
+// matches checks whether the view has the agents of the registry
+func (v *registryView) matches(reg *Registry) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	agents := reg.Agents()
+	if len(agents) != len(v.agents) {
+		return false
+	}
+	for _, agent := range agents {
+		if v.agents[agent.Name] != agent {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RegistryPolicy
+	}{
+		{"reject", RegistryPolicyReject},
+		{"replace", RegistryPolicyReplace},
+		{"suffix", RegistryPolicySuffix},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := NewRegistry(test.policy)
+			view := &registryView{agents: map[string]*Agent{}}
+			events, cancel := reg.Subscribe()
+			defer cancel()
+			go view.follow(events)
+			// Several agents connect with the same name at the same time,
+			// and held records the names reserved or registered, which
+			// nobody else can take unless they are replaced
+			exclusive := test.policy != RegistryPolicyReplace
+			var held sync.Map
+			var wg sync.WaitGroup
+			errs := make(chan error, 8)
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						// I reserve the name, which is never taken with the
+						// suffix policy...
+						name, err := reg.Reserve("sensor")
+						if err != nil {
+							if !errors.Is(err, ErrNameTaken) || test.policy == RegistryPolicySuffix {
+								errs <- err
+								return
+							}
+							continue
+						}
+						// ... checking that nobody else holds it...
+						if _, taken := held.LoadOrStore(name, true); taken && exclusive {
+							errs <- errors.New("name \"" + name + "\" held twice")
+							return
+						}
+						// ... and I either give it up or register the agent,
+						// looking it up and unregistering it
+						if (i+j)%3 == 0 {
+							held.Delete(name)
+							reg.Release(name)
+							continue
+						}
+						agent := testAgent(t, name)
+						reg.Register(agent)
+						if found, ok := reg.Lookup(name); !ok || (found != agent && exclusive) {
+							errs <- errors.New("agent \"" + name + "\" not registered")
+							return
+						}
+						reg.Agents()
+						held.Delete(name)
+						reg.Unregister(agent)
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+			// In the end, the events describe the registry
+			deadline := time.Now().Add(time.Second)
+			for !view.matches(reg) {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected the events to describe the registry %v", reg.Agents())
+				}
+				time.Sleep(time.Millisecond)
+			}
+			view.lock.Lock()
+			defer view.lock.Unlock()
+			if view.err != nil {
+				t.Fatal(view.err)
+			}
+		})
+	}
+}
+
+func TestRegistryReplace(t *testing.T) {
+	reg := NewRegistry(RegistryPolicyReplace)
+	// A registered agent is replaced by a new one with the same name...
+	name, err := reg.Reserve("sensor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := testAgent(t, name)
+	reg.Register(old)
+	name, err = reg.Reserve("sensor")
+	if err != nil {
+		t.Fatalf("expected the name to be reserved, got %v", err)
+	}
+	// ... but two agents cannot connect with the same name at once...
+	if _, err := reg.Reserve("sensor"); !errors.Is(err, ErrNameTaken) {
+		t.Fatalf("expected the name to be taken, got %v", err)
+	}
+	// ... and the old agent is closed once the new one is registered
+	agent := testAgent(t, name)
+	reg.Register(agent)
+	select {
+	case <-old.Mux.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the old agent to be closed")
+	}
+	if found, _ := reg.Lookup("sensor"); found != agent {
+		t.Fatal("expected the new agent to be registered")
+	}
+	// The old agent cannot unregister the new one
+	if reg.Unregister(old) {
+		t.Fatal("expected the old agent not to be unregistered")
+	}
+}
+
+func TestRegistrySuffix(t *testing.T) {
+	reg := NewRegistry(RegistryPolicySuffix)
+	expected := []string{"sensor", "sensor-2", "sensor-3"}
+	for _, e := range expected {
+		name, err := reg.Reserve("sensor")
+		if err != nil || name != e {
+			t.Fatalf("expected name %s, got %s, %v", e, name, err)
+		}
+	}
+	// A released name can be reserved again
+	reg.Release("sensor-2")
+	if name, _ := reg.Reserve("sensor"); name != "sensor-2" {
+		t.Fatalf("expected name sensor-2, got %s", name)
+	}
+}
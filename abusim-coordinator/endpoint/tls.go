@@ -0,0 +1,73 @@
+package endpoint
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// LoadTLSConfig creates the TLS configuration of the listener from the
+// certificate and key files; if a client CA file is specified, the agents
+// must present a certificate signed by it (mutual TLS)
+func LoadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	// I load the certificate of the coordinator...
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	// ... and, if needed, the CA of the agents certificates
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in \"%s\"", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// peerIdentities returns the identities of the verified client certificate
+// of a connection, and whether there is one
+func peerIdentities(conn net.Conn) ([]string, bool) {
+	// I look for the connection carrying the agent connection, if any...
+	if c, ok := conn.(interface{ UnderlyingConn() net.Conn }); ok {
+		conn = c.UnderlyingConn()
+	}
+	// ... I check whether the connection uses TLS with a client certificate...
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, false
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil, false
+	}
+	// ... and I return its common name and DNS names
+	cert := state.PeerCertificates[0]
+	identities := []string{}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	return append(identities, cert.DNSNames...), true
+}
+
+// matchesIdentity checks whether an agent name is one of the certificate identities
+func matchesIdentity(identities []string, name string) bool {
+	for _, identity := range identities {
+		if identity == name {
+			return true
+		}
+	}
+	return false
+}
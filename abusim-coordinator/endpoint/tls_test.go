@@ -0,0 +1,311 @@
+package endpoint
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abu-lang/abusim-core/schema"
+)
+
+// testCA represents a certificate authority generated for a test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA generates a self-signed certificate authority
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue generates a certificate signed by the authority, for a server or a
+// client, returning it with its key in PEM format
+func (ca *testCA) issue(t *testing.T, commonName string, dnsNames []string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientConfig returns the TLS configuration of an agent trusting the
+// authority of the coordinator, with a client certificate if specified
+func clientConfig(t *testing.T, serverCA *testCA, certPEM, keyPEM []byte) *tls.Config {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(serverCA.pem)
+	cfg := &tls.Config{
+		RootCAs:    pool,
+		ServerName: "localhost",
+	}
+	if certPEM != nil {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg
+}
+
+// startTLSCoordinator writes the certificates of the coordinator, loads
+// them with LoadTLSConfig and accepts the agents on a local port
+func startTLSCoordinator(t *testing.T, serverCA, clientCA *testCA) (string, *Registry) {
+	t.Helper()
+	// I write the certificate files...
+	dir := t.TempDir()
+	certPEM, keyPEM := serverCA.issue(t, "coordinator", []string{"localhost"}, x509.ExtKeyUsageServerAuth)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	clientCAFile := ""
+	files := map[string][]byte{certFile: certPEM, keyFile: keyPEM}
+	if clientCA != nil {
+		clientCAFile = filepath.Join(dir, "ca.pem")
+		files[clientCAFile] = clientCA.pem
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// ... I load the configuration...
+	tlsConfig, err := LoadTLSConfig(certFile, keyFile, clientCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ... and I accept the agents
+	listener, err := Listen("tcp://127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := NewRegistry(RegistryPolicyReject)
+	go HandleConnections(listener, reg, Config{
+		Heartbeat: HeartbeatConfig{
+			Interval:  time.Hour,
+			Timeout:   time.Second,
+			DeadAfter: time.Hour,
+		},
+	})
+	t.Cleanup(func() {
+		listener.Close()
+		for _, agent := range reg.Agents() {
+			agent.Close()
+		}
+	})
+	return listener.Addr().String(), reg
+}
+
+func TestMutualTLSIdentity(t *testing.T) {
+	serverCA := newTestCA(t, "server CA")
+	clientCA := newTestCA(t, "client CA")
+	addr, _ := startTLSCoordinator(t, serverCA, clientCA)
+	certPEM, keyPEM := clientCA.issue(t, "sensor", []string{"sensor.lab", "sensor-backup"}, x509.ExtKeyUsageClientAuth)
+	tests := []struct {
+		name     string
+		accepted bool
+	}{
+		{"sensor", true},
+		{"sensor.lab", true},
+		{"sensor-backup", true},
+		{"actuator", false},
+		{"Sensor", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &schema.Dialer{TLSConfig: clientConfig(t, serverCA, certPEM, keyPEM)}
+			end, err := d.Dial(addr, test.name)
+			if test.accepted {
+				if err != nil {
+					t.Fatalf("expected the agent to be accepted, got %v", err)
+				}
+				end.Close()
+				return
+			}
+			handshakeErr := &schema.HandshakeError{}
+			if !errors.As(err, &handshakeErr) || handshakeErr.Reason != schema.EndpointAckReasonIdentityMismatch {
+				t.Fatalf("expected an identity mismatch, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMutualTLSUnverifiedClient(t *testing.T) {
+	serverCA := newTestCA(t, "server CA")
+	clientCA := newTestCA(t, "client CA")
+	otherCA := newTestCA(t, "other CA")
+	addr, reg := startTLSCoordinator(t, serverCA, clientCA)
+	otherCert, otherKey := otherCA.issue(t, "sensor", nil, x509.ExtKeyUsageClientAuth)
+	tests := []struct {
+		name    string
+		certPEM []byte
+		keyPEM  []byte
+	}{
+		{"no certificate", nil, nil},
+		{"untrusted certificate", otherCert, otherKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := &schema.Dialer{TLSConfig: clientConfig(t, serverCA, test.certPEM, test.keyPEM)}
+			end, err := d.Dial(addr, "sensor")
+			if err == nil {
+				end.Close()
+				t.Fatal("expected the agent to be rejected")
+			}
+			if _, ok := reg.Lookup("sensor"); ok {
+				t.Fatal("expected the agent not to be registered")
+			}
+		})
+	}
+}
+
+func TestTLSWithoutClientCertificates(t *testing.T) {
+	serverCA := newTestCA(t, "server CA")
+	addr, _ := startTLSCoordinator(t, serverCA, nil)
+	// Without mutual TLS any name is accepted
+	d := &schema.Dialer{TLSConfig: clientConfig(t, serverCA, nil, nil)}
+	end, err := d.Dial(addr, "anyone")
+	if err != nil {
+		t.Fatalf("expected the agent to be accepted, got %v", err)
+	}
+	end.Close()
+	// An agent not trusting the coordinator certificate does not connect
+	d = &schema.Dialer{TLSConfig: clientConfig(t, newTestCA(t, "other CA"), nil, nil)}
+	end, err = d.Dial(addr, "anyone-else")
+	if err == nil {
+		end.Close()
+		t.Fatal("expected the coordinator certificate to be refused")
+	}
+}
+
+func TestPeerIdentities(t *testing.T) {
+	ca := newTestCA(t, "CA")
+	serverCert, serverKey := ca.issue(t, "coordinator", []string{"localhost"}, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "sensor", []string{"sensor.lab"}, x509.ExtKeyUsageClientAuth)
+	cert, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+	tests := []struct {
+		name       string
+		clientAuth tls.ClientAuthType
+		certPEM    []byte
+		keyPEM     []byte
+		identities []string
+		ok         bool
+	}{
+		{"verified certificate", tls.RequireAndVerifyClientCert, clientCert, clientKey, []string{"sensor", "sensor.lab"}, true},
+		{"unverified certificate", tls.RequireAnyClientCert, clientCert, clientKey, nil, false},
+		{"no certificate", tls.NoClientCert, nil, nil, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// I connect a client and a server over a pipe...
+			serverConn, clientConn := net.Pipe()
+			server := tls.Server(serverConn, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				ClientCAs:    pool,
+				ClientAuth:   test.clientAuth,
+			})
+			client := tls.Client(clientConn, clientConfig(t, ca, test.certPEM, test.keyPEM))
+			// The pipe is unbuffered, so I close it directly instead of
+			// waiting for the TLS closure alerts to be read
+			defer serverConn.Close()
+			defer clientConn.Close()
+			errs := make(chan error, 1)
+			go func() {
+				errs <- client.Handshake()
+			}()
+			if err := server.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+			// ... and I check the identities seen by the server
+			identities, ok := peerIdentities(server)
+			if ok != test.ok {
+				t.Fatalf("expected ok %v, got %v", test.ok, ok)
+			}
+			if len(identities) != len(test.identities) {
+				t.Fatalf("expected identities %v, got %v", test.identities, identities)
+			}
+			for i := range identities {
+				if identities[i] != test.identities[i] {
+					t.Fatalf("expected identities %v, got %v", test.identities, identities)
+				}
+			}
+		})
+	}
+	// Plain connections have no identities
+	plain, other := net.Pipe()
+	defer plain.Close()
+	defer other.Close()
+	if _, ok := peerIdentities(plain); ok {
+		t.Fatal("expected no identities on a plain connection")
+	}
+}
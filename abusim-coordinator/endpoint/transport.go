@@ -0,0 +1,163 @@
+package endpoint
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/abu-lang/abusim-core/schema"
+
+	"github.com/gorilla/websocket"
+)
+
+// Listen returns a listener for the agents on an address in the form
+// transport://address, or host:port for TCP, using TLS on TCP and Unix
+// sockets if a configuration is specified; with WebSocket the address is
+// host:port/path, and wss requires a TLS configuration while ws never uses
+// it, as the pipes, which do not leave the process
+func Listen(addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	// I get the transport...
+	transport, address, err := schema.ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if transport == schema.TransportWebSocketTLS && tlsConfig == nil {
+		return nil, fmt.Errorf("%s requires a TLS certificate", addr)
+	}
+	// ... I create the listener carrying the connections...
+	path := ""
+	var listener net.Listener
+	switch transport {
+	case schema.TransportUnix:
+		removeStaleSocket(address)
+		listener, err = net.Listen("unix", address)
+	case schema.TransportPipe:
+		listener, err = schema.ListenPipe(address)
+	case schema.TransportWebSocket, schema.TransportWebSocketTLS:
+		if i := strings.Index(address, "/"); i >= 0 {
+			address, path = address[:i], address[i:]
+		}
+		listener, err = net.Listen("tcp", address)
+	default:
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// ... I wrap it with TLS, if needed...
+	if tlsConfig != nil && transport != schema.TransportWebSocket && transport != schema.TransportPipe {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	// ... and, for WebSocket, I serve the upgrades on it
+	if transport == schema.TransportWebSocket || transport == schema.TransportWebSocketTLS {
+		return newWebSocketListener(listener, path), nil
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes a Unix socket left by a previous run, so that
+// it can be listened again
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	// I remove it only if nobody is listening on it
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// webSocketListener is a listener accepting the agents connecting over
+// WebSocket
+type webSocketListener struct {
+	listener net.Listener
+	server   *http.Server
+	conns    chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+// newWebSocketListener creates a WebSocket listener serving the upgrades
+// on the specified path of a listener
+func newWebSocketListener(listener net.Listener, path string) *webSocketListener {
+	// I create the listener...
+	l := &webSocketListener{
+		listener: listener,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, l.upgrade)
+	l.server = &http.Server{
+		Handler: mux,
+	}
+	// ... and I start serving
+	go func() {
+		err := l.server.Serve(listener)
+		if err != http.ErrServerClosed {
+			log.Println(err)
+		}
+		l.Close()
+	}()
+	return l
+}
+
+// upgrader upgrades the HTTP connections to WebSocket; the agents are
+// authenticated by the handshake, so they can come from any origin
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// upgrade upgrades an HTTP connection and passes it to Accept
+func (l *webSocketListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	// I upgrade the connection...
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// ... and I pass it to Accept
+	select {
+	case l.conns <- schema.NewWebSocketConn(ws):
+	case <-l.done:
+		ws.Close()
+	}
+}
+
+// Accept waits for a connection
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener
+func (l *webSocketListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.server.Close()
+	})
+	return nil
+}
+
+// Addr returns the address of the listener
+func (l *webSocketListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
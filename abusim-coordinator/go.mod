@@ -5,6 +5,7 @@ go 1.16
 require (
 	github.com/abu-lang/abusim-core/schema v1.0.0
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/rs/cors v1.8.0
 )
 
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/abu-lang/abusim-core/abusim-coordinator/api"
 	"github.com/abu-lang/abusim-core/abusim-coordinator/endpoint"
@@ -13,33 +17,95 @@ import (
 )
 
 func main() {
-	// I create a map for the endpoints...
-	ends := make(map[string]*schema.Endpoint)
+	// I parse the command line flags...
+	listen := flag.String("listen", "tcp://:5001", "comma separated addresses for the agents, in the form transport://address with transport tcp, unix, ws, wss or pipe")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 5*time.Second, "time between two heartbeats to an agent")
+	heartbeatTimeout := flag.Duration("heartbeat-timeout", 2*time.Second, "time after which an unanswered heartbeat makes an agent suspect")
+	deadTimeout := flag.Duration("dead-timeout", 30*time.Second, "time without contact after which an agent is dropped")
+	requestTimeout := flag.Duration("request-timeout", 10*time.Second, "maximum duration of a request to an agent")
+	pollInterval := flag.Duration("poll-interval", time.Second, "time between two polls of the memory of an agent whose changes are streamed")
+	namePolicy := flag.String("name-policy", "replace", "how to handle an agent connecting with a taken name (reject, replace or suffix)")
+	maxFrameSize := flag.Int("max-frame-size", schema.DefaultMaxFrameSize, "maximum size in bytes of a message exchanged with an agent")
+	compression := flag.Bool("compression", true, "compress the messages exchanged with the agents supporting it")
+	compressionThreshold := flag.Int("compression-threshold", schema.DefaultCompressionThreshold, "size in bytes from which the messages are compressed")
+	tlsCert := flag.String("tls-cert", "", "certificate file of the agents listener, enables TLS")
+	tlsKey := flag.String("tls-key", "", "key file of the agents listener certificate")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file of the agents certificates, enables mutual TLS")
+	secret := flag.String("secret", "", "shared secret that the agents must prove to know, $"+schema.SecretEnv+" if not specified")
+	auditLog := flag.String("audit-log", "", "file where the rejected join attempts are recorded")
+	flag.Parse()
+	if *secret == "" {
+		*secret = os.Getenv(schema.SecretEnv)
+	}
+	policy, err := endpoint.ParseRegistryPolicy(*namePolicy)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// ... I create a registry for the agents...
+	reg := endpoint.NewRegistry(policy)
 	// ... I set up the handler to close the connections...
-	setupCloseHandler(ends)
-	// ... I listen for connection...
-	log.Println("Starting listener")
-	listener := endpoint.GetListener()
-	defer listener.Close()
-	// ... I handle the incoming connections...
-	go endpoint.HandleConnections(listener, ends)
+	setupCloseHandler(reg)
+	// ... I load the TLS configuration, if any...
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		tlsConfig, err = endpoint.LoadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	} else if *tlsClientCA != "" {
+		log.Fatalln("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+	// ... I open the audit log, if any...
+	var audit *endpoint.AuditLog
+	if *auditLog != "" {
+		audit, err = endpoint.OpenAuditLog(*auditLog)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer audit.Close()
+	}
+	// ... I handle the incoming connections on every address...
+	cfg := endpoint.Config{
+		MaxFrameSize:         *maxFrameSize,
+		Compression:          *compression,
+		CompressionThreshold: *compressionThreshold,
+		Secret:               []byte(*secret),
+		Audit:                audit,
+		Heartbeat: endpoint.HeartbeatConfig{
+			Interval:  *heartbeatInterval,
+			Timeout:   *heartbeatTimeout,
+			DeadAfter: *deadTimeout,
+		},
+	}
+	for _, addr := range strings.Split(*listen, ",") {
+		log.Printf("Starting listener on %s\n", addr)
+		listener, err := endpoint.Listen(strings.TrimSpace(addr), tlsConfig)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer listener.Close()
+		go endpoint.HandleConnections(listener, reg, cfg)
+	}
 	// ... and I serve the API
 	log.Println("Starting API")
-	api.Serve(ends)
+	api.Serve(reg, api.Config{
+		RequestTimeout: *requestTimeout,
+		PollInterval:   *pollInterval,
+	})
 }
 
 // setupCloseHandler waits for a SIGTERM and then closes all the connections
-func setupCloseHandler(ends map[string]*schema.Endpoint) {
+func setupCloseHandler(reg *endpoint.Registry) {
 	// I register for the SIGTERMs...
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	// ... and I run a goroutine to handle their arrival
 	go func() {
 		// I block until a SIGTERM...
 		<-c
 		// ... I close all the connections...
-		for _, end := range ends {
-			end.Close()
+		for _, agent := range reg.Agents() {
+			agent.Close()
 		}
 		// ... and I exit
 		os.Exit(0)
@@ -0,0 +1,398 @@
+package schema
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// AgentHandler represents the agent side implementation of the requests
+// that the coordinator can perform; the errors returned by the methods are
+// sent to the coordinator as ERROR messages, with the code of an AgentError
+// or with EndpointErrorRejected for any other error, except for the errors
+// of Input, which are sent in the input response
+type AgentHandler interface {
+	// Memory returns the current memory and pool of the agent
+	Memory() (MemoryResources, [][]PoolElem, error)
+	// Input applies an input to the agent memory
+	Input(input string) error
+	// Config returns the agent configuration
+	Config() (AgentConfiguration, error)
+	// Debug returns the agent debug status
+	Debug() (paused bool, verbosity string, err error)
+	// DebugChange changes the agent debug status
+	DebugChange(paused bool, verbosity string) error
+	// DebugStep executes a single step of the agent
+	DebugStep() error
+}
+
+// HandshakeTimeout is the maximum duration of the initialization handshake
+const HandshakeTimeout = 10 * time.Second
+
+// Dialer contains the options to connect to the coordinator
+type Dialer struct {
+	// TLSConfig is the TLS configuration of the connection, nil means no
+	// TLS; with mutual TLS the agent name must match the client certificate
+	TLSConfig *tls.Config
+	// Secret is the shared secret used to answer the authentication
+	// challenge of the coordinator, if it sends one
+	Secret []byte
+	// Push means that the agent sends push messages, including every
+	// change of its memory, so that the coordinator does not poll it
+	Push bool
+	// Labels are the key/value pairs describing the agent, such as its
+	// room or kind, with the syntax checked by ValidateLabels
+	Labels map[string]string
+}
+
+// Dial connects to the coordinator at the specified address and performs
+// the initialization handshake using the specified agent name
+func Dial(addr, name string) (*Endpoint, error) {
+	return (&Dialer{}).Dial(addr, name)
+}
+
+// Dial connects to the coordinator at the specified address using the
+// dialer options and performs the initialization handshake using the
+// specified agent name; the address has the form transport://address, or
+// host:port for TCP
+func (d *Dialer) Dial(addr, name string) (*Endpoint, error) {
+	// I check the labels, since the coordinator would reject them...
+	err := ValidateLabels(d.Labels)
+	if err != nil {
+		return nil, err
+	}
+	// ... I connect to the coordinator...
+	conn, err := d.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	// ... and I perform the handshake
+	return d.Handshake(conn, name)
+}
+
+// Handshake performs the initialization handshake on a connection to the
+// coordinator using the specified agent name, closing the connection if it fails
+func (d *Dialer) Handshake(conn net.Conn, name string) (*Endpoint, error) {
+	// I create a new endpoint...
+	end := New(conn)
+	// ... I send the initialization message...
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	err := end.WriteContext(ctx, &EndpointMessage{
+		Type: EndpointMessageTypeINIT,
+		Payload: &EndpointMessagePayloadINIT{
+			Name:         name,
+			Version:      ProtocolVersion,
+			Capabilities: d.capabilities(),
+			Codecs:       CodecNames(),
+			Compressions: SupportedCompressions,
+			Labels:       d.Labels,
+		},
+	})
+	if err != nil {
+		end.Close()
+		return nil, err
+	}
+	// ... I wait for the acknowledgement, answering the authentication
+	// challenge if the coordinator sends one...
+	err = end.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	if err != nil {
+		end.Close()
+		return nil, err
+	}
+	msg, err := end.Read()
+	if err != nil {
+		end.Close()
+		return nil, err
+	}
+	if msg.Type == EndpointMessageTypeCHALLENGE {
+		msg, err = d.authenticate(ctx, end, msg, name)
+		if err != nil {
+			end.Close()
+			return nil, err
+		}
+	}
+	err = end.SetReadDeadline(time.Time{})
+	if err != nil {
+		end.Close()
+		return nil, err
+	}
+	ack, ok := msg.Payload.(*EndpointMessagePayloadACK)
+	if msg.Type != EndpointMessageTypeACK || !ok {
+		end.Close()
+		return nil, fmt.Errorf("unexpected handshake response of type %d", msg.Type)
+	}
+	// ... I check whether I was accepted...
+	if ack.Reason != EndpointAckReasonAccepted {
+		end.Close()
+		return nil, &HandshakeError{
+			Reason:  ack.Reason,
+			Message: ack.Message,
+		}
+	}
+	// ... I keep the assigned name and the negotiated capabilities...
+	end.SetName(ack.Name)
+	end.SetCapabilities(ack.Capabilities)
+	// ... I switch to the negotiated codec, if any...
+	if ack.Codec != "" {
+		codec, ok := CodecByName(ack.Codec)
+		if !ok {
+			end.Close()
+			return nil, fmt.Errorf("unsupported codec \"%s\"", ack.Codec)
+		}
+		end.SetCodec(codec)
+	}
+	// ... and I enable the negotiated compression, if any
+	if ack.Compression != "" {
+		if !HasCapability(SupportedCompressions, ack.Compression) {
+			end.Close()
+			return nil, fmt.Errorf("unsupported compression \"%s\"", ack.Compression)
+		}
+		end.SetCompression(ack.Compression)
+	}
+	return end, nil
+}
+
+// capabilities returns the capabilities offered to the coordinator
+func (d *Dialer) capabilities() []string {
+	capabilities := []string{}
+	for _, c := range SupportedCapabilities {
+		if c != CapabilityPush || d.Push {
+			capabilities = append(capabilities, c)
+		}
+	}
+	return capabilities
+}
+
+// authenticate answers an authentication challenge and returns the message
+// that follows it
+func (d *Dialer) authenticate(ctx context.Context, end *Endpoint, msg *EndpointMessage, name string) (*EndpointMessage, error) {
+	// I check that I can answer the challenge...
+	challenge, ok := msg.Payload.(*EndpointMessagePayloadCHALLENGE)
+	if !ok {
+		return nil, invalidPayload(msg)
+	}
+	if len(d.Secret) == 0 {
+		return nil, ErrSecretRequired
+	}
+	// ... I send the answer...
+	err := end.WriteContext(ctx, &EndpointMessage{
+		Type: EndpointMessageTypeAUTH,
+		Payload: &EndpointMessagePayloadAUTH{
+			MAC: ComputeMAC(d.Secret, challenge.Nonce, name),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// ... and I wait for the next message
+	return end.Read()
+}
+
+// dial opens the connection to the coordinator on the transport of the
+// address, with TLS if configured
+func (d *Dialer) dial(addr string) (net.Conn, error) {
+	// I get the transport...
+	transport, address, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	// ... and I connect with it
+	dialer := &net.Dialer{
+		Timeout: HandshakeTimeout,
+	}
+	switch transport {
+	case TransportWebSocket, TransportWebSocketTLS:
+		wsDialer := &websocket.Dialer{
+			HandshakeTimeout: HandshakeTimeout,
+			TLSClientConfig:  d.TLSConfig,
+		}
+		ws, _, err := wsDialer.Dial(transport+"://"+address, nil)
+		if err != nil {
+			return nil, err
+		}
+		return NewWebSocketConn(ws), nil
+	case TransportPipe:
+		return DialPipe(address)
+	}
+	if d.TLSConfig == nil {
+		return dialer.Dial(transport, address)
+	}
+	return tls.DialWithDialer(dialer, transport, address, d.TLSConfig)
+}
+
+// ServeAgent reads the requests from the endpoint, executes them using the
+// handler and writes the responses, until the endpoint fails
+func ServeAgent(end *Endpoint, h AgentHandler) error {
+	// Forever...
+	for {
+		// ... I get a request...
+		req, err := end.Read()
+		if recoverable(err) {
+			// I cannot answer a request that cannot be decoded, so I skip it
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// ... I execute it, answering with an error message if it fails
+		// and the coordinator supports them...
+		res, err := handleRequest(req, h)
+		if err != nil {
+			if !end.HasCapability(CapabilityError) {
+				return err
+			}
+			res = errorMessage(req, err)
+		}
+		// ... and I send the response, using the same ID of the request
+		res.ID = req.ID
+		err = end.Write(res)
+		// If the response does not fit in a frame, I answer with an error
+		if recoverable(err) && end.HasCapability(CapabilityError) {
+			res = errorMessage(req, &AgentError{
+				Code:    EndpointErrorInternal,
+				Message: err.Error(),
+			})
+			res.ID = req.ID
+			err = end.Write(res)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleRequest executes a request using the handler and returns the response
+func handleRequest(req *EndpointMessage, h AgentHandler) (*EndpointMessage, error) {
+	// I execute the correct procedure based on the request type
+	switch req.Type {
+	case EndpointMessageTypeMemoryREQ:
+		memory, pool, err := h.Memory()
+		if err != nil {
+			return nil, err
+		}
+		return &EndpointMessage{
+			Type: EndpointMessageTypeMemoryRES,
+			Payload: &EndpointMessagePayloadMemoryRES{
+				Memory: memory,
+				Pool:   pool,
+			},
+		}, nil
+	case EndpointMessageTypeInputREQ:
+		payload, ok := req.Payload.(*EndpointMessagePayloadInputREQ)
+		if !ok {
+			return nil, invalidPayload(req)
+		}
+		errInput := ""
+		if err := h.Input(payload.Input); err != nil {
+			errInput = err.Error()
+		}
+		return &EndpointMessage{
+			Type: EndpointMessageTypeInputRES,
+			Payload: &EndpointMessagePayloadInputRES{
+				Error: errInput,
+			},
+		}, nil
+	case EndpointMessageTypeConfigREQ:
+		config, err := h.Config()
+		if err != nil {
+			return nil, err
+		}
+		return &EndpointMessage{
+			Type: EndpointMessageTypeConfigRES,
+			Payload: &EndpointMessagePayloadConfigRES{
+				Agent: config,
+			},
+		}, nil
+	case EndpointMessageTypeDebugREQ:
+		paused, verbosity, err := h.Debug()
+		if err != nil {
+			return nil, err
+		}
+		return &EndpointMessage{
+			Type: EndpointMessageTypeDebugRES,
+			Payload: &EndpointMessagePayloadDebugRES{
+				Paused:    paused,
+				Verbosity: verbosity,
+			},
+		}, nil
+	case EndpointMessageTypeDebugChangeREQ:
+		payload, ok := req.Payload.(*EndpointMessagePayloadDebugChangeREQ)
+		if !ok {
+			return nil, invalidPayload(req)
+		}
+		err := h.DebugChange(payload.Paused, payload.Verbosity)
+		if err != nil {
+			return nil, err
+		}
+		return &EndpointMessage{
+			Type:    EndpointMessageTypeDebugChangeRES,
+			Payload: &EndpointMessagePayloadDebugChangeRES{},
+		}, nil
+	case EndpointMessageTypeDebugStepREQ:
+		err := h.DebugStep()
+		if err != nil {
+			return nil, err
+		}
+		return &EndpointMessage{
+			Type:    EndpointMessageTypeDebugStepRES,
+			Payload: &EndpointMessagePayloadDebugStepRES{},
+		}, nil
+	case EndpointMessageTypePING:
+		return &EndpointMessage{
+			Type:    EndpointMessageTypePONG,
+			Payload: &EndpointMessagePayloadPONG{},
+		}, nil
+	case EndpointMessageTypeSyncREQ:
+		payload, ok := req.Payload.(*EndpointMessagePayloadSyncREQ)
+		if !ok {
+			return nil, invalidPayload(req)
+		}
+		return &EndpointMessage{
+			Type: EndpointMessageTypeSyncRES,
+			Payload: &EndpointMessagePayloadSyncRES{
+				Token: payload.Token,
+			},
+		}, nil
+	}
+	return nil, &AgentError{
+		Code:    EndpointErrorUnsupported,
+		Message: fmt.Sprintf("unexpected request of type %d", req.Type),
+		Request: req.Type,
+	}
+}
+
+// invalidPayload returns the error for a request with an invalid payload
+func invalidPayload(req *EndpointMessage) error {
+	return &AgentError{
+		Code:    EndpointErrorInvalidPayload,
+		Message: fmt.Sprintf("invalid payload for message of type %d", req.Type),
+		Request: req.Type,
+	}
+}
+
+// errorMessage returns the error message answering a failed request
+func errorMessage(req *EndpointMessage, err error) *EndpointMessage {
+	// I get the error code, if there is one...
+	agentErr := &AgentError{}
+	if !errors.As(err, &agentErr) {
+		agentErr = &AgentError{
+			Code:    EndpointErrorRejected,
+			Message: err.Error(),
+		}
+	}
+	// ... and I create the message
+	return &EndpointMessage{
+		Type: EndpointMessageTypeERROR,
+		Payload: &EndpointMessagePayloadERROR{
+			Code:    agentErr.Code,
+			Message: agentErr.Message,
+			Request: req.Type,
+		},
+	}
+}
@@ -0,0 +1,32 @@
+package schema
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// SecretEnv is the environment variable conventionally holding the shared
+// secret of a simulation
+const SecretEnv = "ABUSIM_SECRET"
+
+// NonceSize is the size in bytes of the nonce of an authentication challenge
+const NonceSize = 32
+
+// ErrSecretRequired is returned when the coordinator requires an
+// authentication and the agent has no secret
+var ErrSecretRequired = errors.New("the coordinator requires a shared secret")
+
+// ComputeMAC returns the answer to an authentication challenge, that is the
+// HMAC-SHA256 of the nonce followed by the agent name, keyed with the secret
+func ComputeMAC(secret, nonce []byte, name string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+// VerifyMAC checks the answer to an authentication challenge in constant time
+func VerifyMAC(secret, nonce []byte, name string, mac []byte) bool {
+	return hmac.Equal(ComputeMAC(secret, nonce, name), mac)
+}
@@ -0,0 +1,143 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec represents an encoding of the messages inside the frames
+type Codec interface {
+	// Name returns the name used to negotiate the codec
+	Name() string
+	// Encode encodes a message
+	Encode(msg *EndpointMessage) ([]byte, error)
+	// Decode decodes a message, choosing the payload type from the message type
+	Decode(data []byte, msg *EndpointMessage) error
+}
+
+// JSONCodec encodes the messages as JSON, it is the codec of the handshake
+var JSONCodec Codec = jsonCodec{}
+
+// MsgpackCodec encodes the messages as MessagePack
+var MsgpackCodec Codec = msgpackCodec{}
+
+// Codecs lists the supported codecs, in order of preference
+var Codecs = []Codec{
+	MsgpackCodec,
+	JSONCodec,
+}
+
+// CodecNames returns the names of the supported codecs, in order of preference
+func CodecNames() []string {
+	names := []string{}
+	for _, c := range Codecs {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+// CodecByName returns the supported codec with the specified name
+func CodecByName(name string) (Codec, bool) {
+	for _, c := range Codecs {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// NegotiateCodec returns the preferred supported codec among the offered
+// ones, or the JSON codec if none is supported
+func NegotiateCodec(offered []string) Codec {
+	for _, c := range Codecs {
+		for _, name := range offered {
+			if c.Name() == name {
+				return c
+			}
+		}
+	}
+	return JSONCodec
+}
+
+// jsonCodec implements the JSON codec
+type jsonCodec struct{}
+
+// Name returns the name of the codec
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// Encode encodes a message as JSON
+func (jsonCodec) Encode(msg *EndpointMessage) ([]byte, error) {
+	buf := bytes.Buffer{}
+	err := json.NewEncoder(&buf).Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes a message from JSON
+func (jsonCodec) Decode(data []byte, msg *EndpointMessage) error {
+	return json.NewDecoder(bytes.NewReader(data)).Decode(msg)
+}
+
+// msgpackCodec implements the MessagePack codec, using the JSON field names
+type msgpackCodec struct{}
+
+// msgpackMessage represents a message whose payload is still encoded
+type msgpackMessage struct {
+	ID      uint64              `json:"id,omitempty"`
+	Type    EndpointMessageType `json:"type"`
+	Payload msgpack.RawMessage  `json:"payload"`
+}
+
+// Name returns the name of the codec
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+// Encode encodes a message as MessagePack
+func (msgpackCodec) Encode(msg *EndpointMessage) ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode decodes a message from MessagePack
+func (msgpackCodec) Decode(data []byte, msg *EndpointMessage) error {
+	// I decode the envelope...
+	raw := msgpackMessage{}
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	err := dec.Decode(&raw)
+	if err != nil {
+		return err
+	}
+	msg.ID = raw.ID
+	msg.Type = raw.Type
+	msg.Payload = nil
+	// ... and, if there is one, I decode the payload with the type of the message
+	payload := newPayload(raw.Type)
+	if payload == nil || len(raw.Payload) == 0 || raw.Payload[0] == msgpackNil {
+		return nil
+	}
+	dec = msgpack.NewDecoder(bytes.NewReader(raw.Payload))
+	dec.SetCustomStructTag("json")
+	err = dec.Decode(payload)
+	if err != nil {
+		return err
+	}
+	msg.Payload = payload
+	return nil
+}
+
+// msgpackNil is the MessagePack encoding of a nil value
+const msgpackNil = 0xc0
@@ -0,0 +1,74 @@
+package schema
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// CompressionFlate compresses the frame bodies with DEFLATE
+const CompressionFlate = "flate"
+
+// DefaultCompressionThreshold is the default size in bytes from which the
+// messages are compressed
+const DefaultCompressionThreshold = 1024
+
+// SupportedCompressions lists the supported compressions, in order of preference
+var SupportedCompressions = []string{
+	CompressionFlate,
+}
+
+// NegotiateCompression returns the preferred supported compression among the
+// offered ones, or an empty string if there is none
+func NegotiateCompression(offered []string) string {
+	for _, c := range SupportedCompressions {
+		if HasCapability(offered, c) {
+			return c
+		}
+	}
+	return ""
+}
+
+// compress compresses a frame body
+func compress(b []byte) ([]byte, error) {
+	// I create a compressor...
+	buf := bytes.Buffer{}
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	// ... and I compress the body
+	_, err = w.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress decompresses a frame body, failing if it exceeds the maximum
+// frame size once decompressed
+func decompress(b []byte, maxSize int) ([]byte, error) {
+	// I decompress the body, reading at most one byte more than allowed...
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	d, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, &FrameError{
+			Err:     ErrFrameMalformed,
+			Message: fmt.Sprintf("cannot decompress: %v", err),
+		}
+	}
+	// ... and I check whether it was too much
+	if len(d) > maxSize {
+		return nil, &FrameError{
+			Err:     ErrFrameTooLarge,
+			Message: fmt.Sprintf("decompressed frame exceeds the maximum of %d bytes", maxSize),
+		}
+	}
+	return d, nil
+}
@@ -2,85 +2,418 @@ package schema
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
 )
 
+// EndpointStats represents the traffic of an endpoint
+type EndpointStats struct {
+	// FramesRead and FramesWritten count the frames
+	FramesRead    int64
+	FramesWritten int64
+	// CompressedRead and CompressedWritten count the compressed frames
+	CompressedRead    int64
+	CompressedWritten int64
+	// BytesRead and BytesWritten count the bytes on the connection,
+	// including the frame headers
+	BytesRead    int64
+	BytesWritten int64
+	// MessageBytesRead and MessageBytesWritten count the bytes of the
+	// encoded messages, before the compression
+	MessageBytesRead    int64
+	MessageBytesWritten int64
+}
+
+// CompressionRatio returns the ratio between the size of the frame bodies
+// on the connection and the size of the encoded messages, 1 without traffic
+func (s EndpointStats) CompressionRatio() float64 {
+	messages := s.MessageBytesRead + s.MessageBytesWritten
+	if messages == 0 {
+		return 1
+	}
+	bodies := s.BytesRead + s.BytesWritten - (s.FramesRead+s.FramesWritten)*FrameHeaderSize
+	return float64(bodies) / float64(messages)
+}
+
 // Endpoint represents an agent-coordinatior connection side
 type Endpoint struct {
 	conn   net.Conn
 	reader *bufio.Reader
-	writer *bufio.Writer
+	wlock  sync.Mutex
+	// codec is the codec of the messages and compression is the compression
+	// of the frames, they change after the handshake
+	clock       sync.Mutex
+	codec       Codec
+	compression string
+
+	maxFrameSize         int
+	compressionThreshold int
+
+	// slock protects the statistics of the endpoint
+	slock          sync.Mutex
+	stats          EndpointStats
+	frameErrors    int
+	lastFrameError *FrameError
+
+	name         string
+	capabilities []string
 }
 
 // New creates a new endpoint from a connection
 func New(conn net.Conn) *Endpoint {
-	// I create a reader and a writer for the connection...
+	// I create a reader for the connection...
 	r := bufio.NewReader(conn)
-	w := bufio.NewWriter(conn)
 	// ... and I return the endpoint
 	return &Endpoint{
 		conn:   conn,
 		reader: r,
-		writer: w,
+		codec:  JSONCodec,
+
+		maxFrameSize:         DefaultMaxFrameSize,
+		compressionThreshold: DefaultCompressionThreshold,
 	}
 }
 
-// Read expect a message and returns it
+// Read expect a message and returns it, a failure in reading the frame is
+// returned as a FrameError
 func (e *Endpoint) Read() (*EndpointMessage, error) {
-	// I read the 4 bytes that contains the length of the message...
-	h := make([]byte, 4)
-	_, err := io.ReadFull(e.reader, h)
+	msg, err := e.read()
 	if err != nil {
+		e.countFrameError(err)
 		return nil, err
 	}
-	// ... I get the message length...
-	l := binary.BigEndian.Uint32(h)
+	return msg, nil
+}
+
+// read reads a frame and decodes its message
+func (e *Endpoint) read() (*EndpointMessage, error) {
+	// I read the magic number, rejecting a stray connection as soon as
+	// possible...
+	h := make([]byte, FrameHeaderSize)
+	_, err := io.ReadFull(e.reader, h[:len(FrameMagic)])
+	if err != nil {
+		return nil, truncated(err, "incomplete magic number")
+	}
+	if h[0] != FrameMagic[0] || h[1] != FrameMagic[1] {
+		return nil, &FrameError{
+			Err:     ErrFrameMalformed,
+			Message: fmt.Sprintf("invalid magic number %#x", h[:len(FrameMagic)]),
+			Fatal:   true,
+		}
+	}
+	// ... I read the rest of the header...
+	_, err = io.ReadFull(e.reader, h[len(FrameMagic):])
+	if err != nil {
+		return nil, truncated(err, "incomplete header")
+	}
+	// ... I check the version and the flags...
+	if h[2] != FrameVersion {
+		return nil, &FrameError{
+			Err:     ErrFrameMalformed,
+			Message: fmt.Sprintf("unsupported frame version %d", h[2]),
+			Fatal:   true,
+		}
+	}
+	if h[3]&^frameFlagsKnown != 0 {
+		return nil, &FrameError{
+			Err:     ErrFrameMalformed,
+			Message: fmt.Sprintf("unknown frame flags %#08b", h[3]),
+			Fatal:   true,
+		}
+	}
+	// ... I get the message length, checking that it is allowed...
+	l := binary.BigEndian.Uint32(h[4:])
+	if int64(l) > int64(e.MaxFrameSize()) {
+		return nil, &FrameError{
+			Err:     ErrFrameTooLarge,
+			Message: fmt.Sprintf("frame of %d bytes exceeds the maximum of %d", l, e.MaxFrameSize()),
+			Fatal:   true,
+		}
+	}
 	// ... I read the entire message...
 	b := make([]byte, l)
-	_, err = io.ReadFull(e.reader, b)
+	n, err := io.ReadFull(e.reader, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
-		return nil, err
+		return nil, truncated(err, fmt.Sprintf("read %d of %d bytes", n, l))
 	}
+	// ... I decompress it, if needed, the frame is complete so the next
+	// ones can still be read if something fails from now on...
+	compressed := h[3]&FrameFlagCompressed != 0
+	body := b
+	if compressed {
+		b, err = decompress(b, e.MaxFrameSize())
+		if err != nil {
+			return nil, err
+		}
+	}
+	e.countRead(len(body), len(b), compressed)
 	// ... and I decode it
-	buf := bytes.Buffer{}
-	buf.Write(b)
 	msg := &EndpointMessage{}
-	err = json.NewDecoder(&buf).Decode(msg)
+	err = e.Codec().Decode(b, msg)
 	if err != nil {
-		return nil, err
+		return nil, &FrameError{
+			Err:     ErrFrameMalformed,
+			Message: err.Error(),
+		}
 	}
 	return msg, nil
 }
 
-// Write sends a message
+// truncated returns the error for a frame whose reading ended early
+func truncated(err error, message string) error {
+	if err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return &FrameError{
+		Err:     ErrFrameTruncated,
+		Message: message,
+		Fatal:   true,
+	}
+}
+
+// Write sends a message, it is safe to call it from several goroutines
 func (e *Endpoint) Write(msg *EndpointMessage) error {
-	// I encode the message...
-	buf := bytes.Buffer{}
-	err := json.NewEncoder(&buf).Encode(msg)
+	return e.WriteContext(context.Background(), msg)
+}
+
+// WriteContext sends a message, failing if it is not sent before the
+// context deadline; it is safe to call it from several goroutines, and a
+// FrameError or an error of the context means that nothing was sent
+func (e *Endpoint) WriteContext(ctx context.Context, msg *EndpointMessage) error {
+	err := e.write(ctx, msg)
+	if err != nil {
+		e.countFrameError(err)
+	}
+	return err
+}
+
+// write encodes a message and sends its frame
+func (e *Endpoint) write(ctx context.Context, msg *EndpointMessage) error {
+	// I encode the message, checking that it fits in a frame...
+	b, err := e.Codec().Encode(msg)
+	if err != nil {
+		return &FrameError{
+			Err:     ErrFrameMalformed,
+			Message: err.Error(),
+		}
+	}
+	if len(b) > e.MaxFrameSize() {
+		return &FrameError{
+			Err:     ErrFrameTooLarge,
+			Message: fmt.Sprintf("message of %d bytes exceeds the maximum of %d", len(b), e.MaxFrameSize()),
+		}
+	}
+	// ... I compress it, if it is worth it...
+	body := b
+	compressed := false
+	if e.Compression() == CompressionFlate && len(b) >= e.compressionThreshold {
+		c, err := compress(b)
+		if err != nil {
+			return &FrameError{
+				Err:     ErrFrameMalformed,
+				Message: fmt.Sprintf("cannot compress: %v", err),
+			}
+		}
+		if len(c) < len(b) {
+			body = c
+			compressed = true
+		}
+	}
+	// ... I lock the writer, so that the messages are not interleaved...
+	e.wlock.Lock()
+	defer e.wlock.Unlock()
+	// ... I give up if the context is already done, since nothing is sent...
+	err = ctx.Err()
 	if err != nil {
 		return err
 	}
-	// ... I send the length...
-	h := make([]byte, 4)
-	binary.BigEndian.PutUint32(h, uint32(buf.Len()))
-	_, err = e.writer.Write(h)
+	// ... I set the deadline of the context, if any...
+	deadline, _ := ctx.Deadline()
+	err = e.conn.SetWriteDeadline(deadline)
 	if err != nil {
 		return err
 	}
-	// ... and I send the message itself
-	_, err = e.writer.Write(buf.Bytes())
+	// ... I prepare the header...
+	frame := make([]byte, FrameHeaderSize, FrameHeaderSize+len(body))
+	copy(frame, FrameMagic[:])
+	frame[2] = FrameVersion
+	frame[3] = 0
+	if compressed {
+		frame[3] |= FrameFlagCompressed
+	}
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(body)))
+	// ... and I send the whole frame at once, so that I know whether the
+	// deadline expired before any byte was written, leaving the connection
+	// usable
+	n, err := e.conn.Write(append(frame, body...))
+	if n == 0 && errors.Is(err, os.ErrDeadlineExceeded) && resumable(e.conn) {
+		return context.DeadlineExceeded
+	}
 	if err != nil {
 		return err
 	}
-	// Finally, I flush the writer to ensure the message is gone
-	e.writer.Flush()
+	e.countWrite(len(body), len(b), compressed)
 	return nil
 }
 
+// resumable checks whether a connection can still be written after a write
+// deadline expired: the TLS and the WebSocket connections cannot
+func resumable(conn net.Conn) bool {
+	switch conn.(type) {
+	case *tls.Conn, *WebSocketConn:
+		return false
+	}
+	return true
+}
+
+// countRead updates the statistics with a frame read
+func (e *Endpoint) countRead(bodySize, messageSize int, compressed bool) {
+	e.slock.Lock()
+	defer e.slock.Unlock()
+	e.stats.FramesRead++
+	e.stats.BytesRead += int64(FrameHeaderSize + bodySize)
+	e.stats.MessageBytesRead += int64(messageSize)
+	if compressed {
+		e.stats.CompressedRead++
+	}
+}
+
+// countWrite updates the statistics with a frame written
+func (e *Endpoint) countWrite(bodySize, messageSize int, compressed bool) {
+	e.slock.Lock()
+	defer e.slock.Unlock()
+	e.stats.FramesWritten++
+	e.stats.BytesWritten += int64(FrameHeaderSize + bodySize)
+	e.stats.MessageBytesWritten += int64(messageSize)
+	if compressed {
+		e.stats.CompressedWritten++
+	}
+}
+
+// Stats returns the traffic of the endpoint
+func (e *Endpoint) Stats() EndpointStats {
+	e.slock.Lock()
+	defer e.slock.Unlock()
+	return e.stats
+}
+
+// countFrameError keeps track of an error if it is a FrameError
+func (e *Endpoint) countFrameError(err error) {
+	frameErr := &FrameError{}
+	if !errors.As(err, &frameErr) {
+		return
+	}
+	e.slock.Lock()
+	defer e.slock.Unlock()
+	e.frameErrors++
+	e.lastFrameError = frameErr
+}
+
+// FrameErrors returns how many frames could not be read or written, and
+// the last error
+func (e *Endpoint) FrameErrors() (int, error) {
+	e.slock.Lock()
+	defer e.slock.Unlock()
+	if e.lastFrameError == nil {
+		return 0, nil
+	}
+	return e.frameErrors, e.lastFrameError
+}
+
+// MaxFrameSize returns the maximum size of a frame body in bytes
+func (e *Endpoint) MaxFrameSize() int {
+	return e.maxFrameSize
+}
+
+// SetMaxFrameSize sets the maximum size of a frame body in bytes, it must
+// be called before the endpoint is used
+func (e *Endpoint) SetMaxFrameSize(size int) {
+	e.maxFrameSize = size
+}
+
+// SetReadDeadline sets the deadline for the next reads, a zero value
+// means no deadline
+func (e *Endpoint) SetReadDeadline(t time.Time) error {
+	return e.conn.SetReadDeadline(t)
+}
+
+// Codec returns the codec of the messages
+func (e *Endpoint) Codec() Codec {
+	e.clock.Lock()
+	defer e.clock.Unlock()
+	return e.codec
+}
+
+// SetCodec sets the codec of the messages
+func (e *Endpoint) SetCodec(codec Codec) {
+	e.clock.Lock()
+	defer e.clock.Unlock()
+	e.codec = codec
+}
+
+// Compression returns the compression of the frames written, an empty
+// string means no compression
+func (e *Endpoint) Compression() string {
+	e.clock.Lock()
+	defer e.clock.Unlock()
+	return e.compression
+}
+
+// SetCompression sets the compression of the frames written, the frames
+// read are decompressed according to their header anyway
+func (e *Endpoint) SetCompression(compression string) {
+	e.clock.Lock()
+	defer e.clock.Unlock()
+	e.compression = compression
+}
+
+// SetCompressionThreshold sets the size in bytes from which the messages
+// are compressed, it must be called before the endpoint is used
+func (e *Endpoint) SetCompressionThreshold(threshold int) {
+	e.compressionThreshold = threshold
+}
+
+// Name returns the agent name assigned on the connection
+func (e *Endpoint) Name() string {
+	return e.name
+}
+
+// SetName sets the agent name assigned on the connection
+func (e *Endpoint) SetName(name string) {
+	e.name = name
+}
+
+// Capabilities returns the capabilities negotiated on the connection
+func (e *Endpoint) Capabilities() []string {
+	return e.capabilities
+}
+
+// SetCapabilities sets the capabilities negotiated on the connection
+func (e *Endpoint) SetCapabilities(capabilities []string) {
+	e.capabilities = capabilities
+}
+
+// HasCapability checks whether a capability was negotiated on the connection
+func (e *Endpoint) HasCapability(capability string) bool {
+	return HasCapability(e.capabilities, capability)
+}
+
+// RemoteAddr returns the address of the other side of the connection
+func (e *Endpoint) RemoteAddr() net.Addr {
+	return e.conn.RemoteAddr()
+}
+
 // Close closes the connection
 func (e *Endpoint) Close() {
 	e.conn.Close()
@@ -0,0 +1,289 @@
+package schema
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMessages returns a message of every kind of payload
+func testMessages() []*EndpointMessage {
+	when := time.Date(2026, 10, 17, 9, 30, 0, 0, time.UTC)
+	return []*EndpointMessage{
+		{Type: EndpointMessageTypeINIT, Payload: &EndpointMessagePayloadINIT{
+			Name:         "sensor",
+			Version:      ProtocolVersion,
+			Capabilities: []string{CapabilityResync},
+			Codecs:       CodecNames(),
+			Labels:       map[string]string{"room": "S1"},
+		}},
+		{ID: 1, Type: EndpointMessageTypeMemoryREQ, Payload: &EndpointMessagePayloadMemoryREQ{}},
+		{ID: 1, Type: EndpointMessageTypeMemoryRES, Payload: &EndpointMessagePayloadMemoryRES{
+			Memory: MemoryResources{
+				Bool:    map[string]bool{"on": true},
+				Integer: map[string]int64{"temperature": -20},
+				Float:   map[string]float64{"humidity": 0.5},
+				Text:    map[string]string{"label": "say \"hi\""},
+				Time:    map[string]time.Time{"since": when},
+			},
+			Pool: [][]PoolElem{{{Resource: "on", Value: "false"}}},
+		}},
+		{ID: 2, Type: EndpointMessageTypeInputREQ, Payload: &EndpointMessagePayloadInputREQ{Input: "temperature = 5"}},
+		{ID: 3, Type: EndpointMessageTypeERROR, Payload: &EndpointMessagePayloadERROR{
+			Code:    EndpointErrorRejected,
+			Message: "no",
+			Request: EndpointMessageTypeInputREQ,
+		}},
+		{ID: 4, Type: EndpointMessageTypeSyncREQ, Payload: &EndpointMessagePayloadSyncREQ{Token: "abc"}},
+		{Type: EndpointMessageTypeLogPUSH, Payload: &EndpointMessagePayloadLogPUSH{Time: when, Level: "info", Message: "started"}},
+	}
+}
+
+// normalize converts the times of a message to UTC, since the codecs can
+// decode them in the local time zone
+func normalize(msg *EndpointMessage) {
+	switch p := msg.Payload.(type) {
+	case *EndpointMessagePayloadMemoryRES:
+		for name, t := range p.Memory.Time {
+			p.Memory.Time[name] = t.UTC()
+		}
+	case *EndpointMessagePayloadLogPUSH:
+		p.Time = p.Time.UTC()
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range Codecs {
+		for _, msg := range testMessages() {
+			t.Run(codec.Name(), func(t *testing.T) {
+				b, err := codec.Encode(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded := &EndpointMessage{}
+				err = codec.Decode(b, decoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				normalize(decoded)
+				if !reflect.DeepEqual(decoded, msg) {
+					t.Fatalf("message of type %d changed: expected %+v, got %+v", msg.Type, msg.Payload, decoded.Payload)
+				}
+			})
+		}
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	tests := []struct {
+		offered  []string
+		expected string
+	}{
+		{[]string{"json", "msgpack"}, "msgpack"},
+		{[]string{"json"}, "json"},
+		{[]string{"unknown"}, "json"},
+		{nil, "json"},
+	}
+	for _, test := range tests {
+		if c := NegotiateCodec(test.offered); c.Name() != test.expected {
+			t.Errorf("offered %v: expected %s, got %s", test.offered, test.expected, c.Name())
+		}
+	}
+}
+
+// endpointPair returns two endpoints connected in memory
+func endpointPair(t *testing.T) (*Endpoint, *Endpoint) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return New(a), New(b)
+}
+
+// writeAsync writes the messages on an endpoint without waiting for them
+// to be read, reporting the first error
+func writeAsync(end *Endpoint, msgs ...*EndpointMessage) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			if err := end.Write(msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	return errs
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, codec := range Codecs {
+		for _, compression := range []string{"", CompressionFlate} {
+			t.Run(codec.Name()+"/"+compression, func(t *testing.T) {
+				// I configure both sides the same way, compressing even
+				// the small messages...
+				writer, reader := endpointPair(t)
+				for _, end := range []*Endpoint{writer, reader} {
+					end.SetCodec(codec)
+					end.SetCompression(compression)
+					end.SetCompressionThreshold(0)
+				}
+				// ... and I check that every message arrives unchanged,
+				// including a large one
+				msgs := append(testMessages(), &EndpointMessage{
+					ID:      5,
+					Type:    EndpointMessageTypeInputREQ,
+					Payload: &EndpointMessagePayloadInputREQ{Input: strings.Repeat("x = 1; ", 10000)},
+				})
+				errs := writeAsync(writer, msgs...)
+				for _, msg := range msgs {
+					got, err := reader.Read()
+					if err != nil {
+						t.Fatal(err)
+					}
+					normalize(got)
+					if !reflect.DeepEqual(got, msg) {
+						t.Fatalf("message of type %d changed: expected %+v, got %+v", msg.Type, msg.Payload, got.Payload)
+					}
+				}
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+				if stats := reader.Stats(); compression != "" && stats.CompressionRatio() >= 1 {
+					t.Fatalf("expected the messages to be compressed, got ratio %f", stats.CompressionRatio())
+				}
+			})
+		}
+	}
+}
+
+func TestFrameHeader(t *testing.T) {
+	// I write a message on an endpoint...
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	errs := writeAsync(New(a), &EndpointMessage{ID: 7, Type: EndpointMessageTypePING, Payload: &EndpointMessagePayloadPING{}})
+	// ... and I check its header
+	h := make([]byte, FrameHeaderSize)
+	if _, err := b.Read(h); err != nil {
+		t.Fatal(err)
+	}
+	if h[0] != 'A' || h[1] != 'B' || h[2] != FrameVersion || h[3] != 0 {
+		t.Fatalf("unexpected header %v", h)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(h[4:]))
+	if _, err := b.Read(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	msg := &EndpointMessage{}
+	if err := JSONCodec.Decode(body, msg); err != nil || msg.ID != 7 || msg.Type != EndpointMessageTypePING {
+		t.Fatalf("unexpected body %q: %v", body, err)
+	}
+}
+
+// frame returns a frame with the specified header fields and body
+func frame(magic [2]byte, version, flags byte, length uint32, body []byte) []byte {
+	h := []byte{magic[0], magic[1], version, flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(h[4:], length)
+	return append(h, body...)
+}
+
+func TestFrameErrors(t *testing.T) {
+	valid, err := JSONCodec.Encode(&EndpointMessage{Type: EndpointMessageTypePING, Payload: &EndpointMessagePayloadPING{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		raw   []byte
+		kind  error
+		fatal bool
+	}{
+		{"invalid magic", frame([2]byte{'X', 'Y'}, FrameVersion, 0, 0, nil), ErrFrameMalformed, true},
+		{"unsupported version", frame(FrameMagic, FrameVersion+1, 0, 0, nil), ErrFrameMalformed, true},
+		{"unknown flags", frame(FrameMagic, FrameVersion, 0x80, 0, nil), ErrFrameMalformed, true},
+		{"too large", frame(FrameMagic, FrameVersion, 0, 1025, nil), ErrFrameTooLarge, true},
+		{"truncated header", []byte{'A', 'B', FrameVersion}, ErrFrameTruncated, true},
+		{"truncated body", frame(FrameMagic, FrameVersion, 0, 10, []byte("abc")), ErrFrameTruncated, true},
+		{"undecodable body", frame(FrameMagic, FrameVersion, 0, 3, []byte("{{{")), ErrFrameMalformed, false},
+		{"undecompressible body", frame(FrameMagic, FrameVersion, FrameFlagCompressed, 3, []byte{0xff, 0xff, 0xff}), ErrFrameMalformed, false},
+		{"decompressed too large", frame(FrameMagic, FrameVersion, FrameFlagCompressed, 0, nil), ErrFrameTooLarge, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// A compressed body exceeding the maximum once decompressed
+			raw := test.raw
+			if test.name == "decompressed too large" {
+				body, err := compress(bytes.Repeat([]byte{' '}, 2048))
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw = frame(FrameMagic, FrameVersion, FrameFlagCompressed, uint32(len(body)), body)
+			}
+			// I write the raw frame, followed by a valid one unless the
+			// frame must be truncated, and I close the connection...
+			a, b := net.Pipe()
+			defer b.Close()
+			truncated := errors.Is(test.kind, ErrFrameTruncated)
+			go func() {
+				a.Write(raw)
+				if !truncated {
+					a.Write(frame(FrameMagic, FrameVersion, 0, uint32(len(valid)), valid))
+				}
+				a.Close()
+			}()
+			end := New(b)
+			end.SetMaxFrameSize(1024)
+			// ... I check the error...
+			_, err := end.Read()
+			frameErr := &FrameError{}
+			if !errors.As(err, &frameErr) || !errors.Is(err, test.kind) || frameErr.Fatal != test.fatal {
+				t.Fatalf("expected a frame error %v with fatal %v, got %#v", test.kind, test.fatal, err)
+			}
+			if count, last := end.FrameErrors(); count != 1 || last == nil {
+				t.Fatalf("expected the frame error to be counted, got %d, %v", count, last)
+			}
+			// ... and, if it is not fatal, that the next frame can be read
+			if !test.fatal {
+				msg, err := end.Read()
+				if err != nil || msg.Type != EndpointMessageTypePING {
+					t.Fatalf("expected the next frame, got %v, %v", msg, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	writer, reader := endpointPair(t)
+	writer.SetMaxFrameSize(64)
+	// A message exceeding the maximum is not sent...
+	err := writer.WriteContext(context.Background(), &EndpointMessage{
+		Type:    EndpointMessageTypeInputREQ,
+		Payload: &EndpointMessagePayloadInputREQ{Input: strings.Repeat("x", 100)},
+	})
+	frameErr := &FrameError{}
+	if !errors.As(err, &frameErr) || !errors.Is(err, ErrFrameTooLarge) || frameErr.Fatal {
+		t.Fatalf("expected a recoverable frame error, got %v", err)
+	}
+	// ... so the next one is the first to arrive
+	errs := writeAsync(writer, &EndpointMessage{Type: EndpointMessageTypePING, Payload: &EndpointMessagePayloadPING{}})
+	msg, err := reader.Read()
+	if err != nil || msg.Type != EndpointMessageTypePING {
+		t.Fatalf("expected the next message, got %v, %v", msg, err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,64 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The frames start with a header made of the magic number, the frame
+// version, the flags and the 4 bytes length of the body, big endian
+const (
+	// FrameVersion is the version of the frame header
+	FrameVersion byte = 1
+	// FrameHeaderSize is the size of the frame header in bytes
+	FrameHeaderSize = 8
+	// DefaultMaxFrameSize is the default maximum size of a frame body in bytes
+	DefaultMaxFrameSize = 16 * 1024 * 1024
+)
+
+// FrameMagic is the magic number at the start of every frame
+var FrameMagic = [2]byte{'A', 'B'}
+
+const (
+	// FrameFlagCompressed means that the frame body is compressed
+	FrameFlagCompressed byte = 1 << 0
+)
+
+// frameFlagsKnown contains all the flags that a frame header can have
+const frameFlagsKnown = FrameFlagCompressed
+
+var (
+	// ErrFrameTooLarge means that a frame exceeds the maximum frame size
+	ErrFrameTooLarge = errors.New("frame too large")
+	// ErrFrameTruncated means that the connection ended in the middle of a frame
+	ErrFrameTruncated = errors.New("frame truncated")
+	// ErrFrameMalformed means that a frame header or body is not valid
+	ErrFrameMalformed = errors.New("frame malformed")
+)
+
+// FrameError represents an error in reading or writing a frame, Err is one
+// of ErrFrameTooLarge, ErrFrameTruncated or ErrFrameMalformed
+type FrameError struct {
+	Err     error
+	Message string
+	// Fatal means that the frames cannot be told apart anymore, so the
+	// connection cannot be used
+	Fatal bool
+}
+
+// Error returns the error description
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Message)
+}
+
+// Unwrap returns the kind of the error
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// recoverable checks whether an error is a frame error that leaves the
+// connection usable
+func recoverable(err error) bool {
+	frameErr := &FrameError{}
+	return errors.As(err, &frameErr) && !frameErr.Fatal
+}
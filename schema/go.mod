@@ -1,3 +1,8 @@
 module github.com/abu-lang/abusim-core/schema
 
 go 1.16
+
+require (
+	github.com/gorilla/websocket v1.4.2
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+)
@@ -0,0 +1,86 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxLabelNameLength is the maximum length of a label value and of the
+// name part of a label key
+const MaxLabelNameLength = 63
+
+// MaxLabelPrefixLength is the maximum length of the prefix of a label key
+const MaxLabelPrefixLength = 253
+
+// ValidateLabels checks the keys and the values of the labels of an agent,
+// which follow the syntax of the Kubernetes labels
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if err := ValidateLabelKey(key); err != nil {
+			return err
+		}
+		if err := ValidateLabelValue(value); err != nil {
+			return fmt.Errorf("label \"%s\": %w", key, err)
+		}
+	}
+	return nil
+}
+
+// ValidateLabelKey checks a label key, made of an optional DNS subdomain
+// prefix and a slash followed by a name, such as example.com/room
+func ValidateLabelKey(key string) error {
+	// I split the prefix from the name...
+	name := key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix := key[:i]
+		name = key[i+1:]
+		// ... and I check the prefix, if any...
+		if prefix == "" || len(prefix) > MaxLabelPrefixLength {
+			return fmt.Errorf("invalid label key \"%s\": the prefix must have 1 to %d characters", key, MaxLabelPrefixLength)
+		}
+		for _, part := range strings.Split(prefix, ".") {
+			if !isLabelName(part, false) {
+				return fmt.Errorf("invalid label key \"%s\": the prefix must be a DNS subdomain", key)
+			}
+		}
+	}
+	// ... and the name
+	if name == "" || len(name) > MaxLabelNameLength || !isLabelName(name, true) {
+		return fmt.Errorf("invalid label key \"%s\": the name must have 1 to %d alphanumeric characters, '-', '_' or '.', starting and ending with an alphanumeric character", key, MaxLabelNameLength)
+	}
+	return nil
+}
+
+// ValidateLabelValue checks a label value, which is either empty or has the
+// same syntax of the name of a label key
+func ValidateLabelValue(value string) error {
+	if value == "" {
+		return nil
+	}
+	if len(value) > MaxLabelNameLength || !isLabelName(value, true) {
+		return fmt.Errorf("invalid label value \"%s\": it must have up to %d alphanumeric characters, '-', '_' or '.', starting and ending with an alphanumeric character", value, MaxLabelNameLength)
+	}
+	return nil
+}
+
+// isLabelName checks whether a string is made of alphanumeric characters and
+// dashes, and also of underscores and dots if extended, starting and ending
+// with an alphanumeric character
+func isLabelName(s string, extended bool) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		alnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if alnum {
+			continue
+		}
+		if i == 0 || i == len(s)-1 {
+			return false
+		}
+		if c != '-' && !(extended && (c == '_' || c == '.')) {
+			return false
+		}
+	}
+	return true
+}
@@ -6,6 +6,7 @@ import (
 )
 
 type EndpointMessage struct {
+	ID      uint64              `json:"id,omitempty"`
 	Type    EndpointMessageType `json:"type"`
 	Payload interface{}         `json:"payload"`
 }
@@ -18,40 +19,68 @@ func (m *EndpointMessage) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	m.Type = typ.Type
+	m.Payload = newPayload(typ.Type)
 
-	switch typ.Type {
+	type tmp EndpointMessage // avoids infinite recursion
+	return json.Unmarshal(data, (*tmp)(m))
+}
+
+// newPayload returns an empty payload for a message of the specified type,
+// or nil if the type is unknown
+func newPayload(t EndpointMessageType) interface{} {
+	switch t {
 	case EndpointMessageTypeACK:
-		m.Payload = &EndpointMessagePayloadACK{}
+		return &EndpointMessagePayloadACK{}
 	case EndpointMessageTypeINIT:
-		m.Payload = &EndpointMessagePayloadINIT{}
+		return &EndpointMessagePayloadINIT{}
 	case EndpointMessageTypeMemoryREQ:
-		m.Payload = &EndpointMessagePayloadMemoryREQ{}
+		return &EndpointMessagePayloadMemoryREQ{}
 	case EndpointMessageTypeMemoryRES:
-		m.Payload = &EndpointMessagePayloadMemoryRES{}
+		return &EndpointMessagePayloadMemoryRES{}
 	case EndpointMessageTypeInputREQ:
-		m.Payload = &EndpointMessagePayloadInputREQ{}
+		return &EndpointMessagePayloadInputREQ{}
 	case EndpointMessageTypeInputRES:
-		m.Payload = &EndpointMessagePayloadInputRES{}
+		return &EndpointMessagePayloadInputRES{}
 	case EndpointMessageTypeConfigREQ:
-		m.Payload = &EndpointMessagePayloadConfigREQ{}
+		return &EndpointMessagePayloadConfigREQ{}
 	case EndpointMessageTypeConfigRES:
-		m.Payload = &EndpointMessagePayloadConfigRES{}
+		return &EndpointMessagePayloadConfigRES{}
 	case EndpointMessageTypeDebugREQ:
-		m.Payload = &EndpointMessagePayloadDebugREQ{}
+		return &EndpointMessagePayloadDebugREQ{}
 	case EndpointMessageTypeDebugRES:
-		m.Payload = &EndpointMessagePayloadDebugRES{}
+		return &EndpointMessagePayloadDebugRES{}
 	case EndpointMessageTypeDebugChangeREQ:
-		m.Payload = &EndpointMessagePayloadDebugChangeREQ{}
+		return &EndpointMessagePayloadDebugChangeREQ{}
 	case EndpointMessageTypeDebugChangeRES:
-		m.Payload = &EndpointMessagePayloadDebugChangeRES{}
+		return &EndpointMessagePayloadDebugChangeRES{}
 	case EndpointMessageTypeDebugStepREQ:
-		m.Payload = &EndpointMessagePayloadDebugStepREQ{}
+		return &EndpointMessagePayloadDebugStepREQ{}
 	case EndpointMessageTypeDebugStepRES:
-		m.Payload = &EndpointMessagePayloadDebugStepRES{}
+		return &EndpointMessagePayloadDebugStepRES{}
+	case EndpointMessageTypePING:
+		return &EndpointMessagePayloadPING{}
+	case EndpointMessageTypePONG:
+		return &EndpointMessagePayloadPONG{}
+	case EndpointMessageTypeSyncREQ:
+		return &EndpointMessagePayloadSyncREQ{}
+	case EndpointMessageTypeSyncRES:
+		return &EndpointMessagePayloadSyncRES{}
+	case EndpointMessageTypeERROR:
+		return &EndpointMessagePayloadERROR{}
+	case EndpointMessageTypeCHALLENGE:
+		return &EndpointMessagePayloadCHALLENGE{}
+	case EndpointMessageTypeAUTH:
+		return &EndpointMessagePayloadAUTH{}
+	case EndpointMessageTypeMemoryPUSH:
+		return &EndpointMessagePayloadMemoryPUSH{}
+	case EndpointMessageTypeRulePUSH:
+		return &EndpointMessagePayloadRulePUSH{}
+	case EndpointMessageTypeInputPUSH:
+		return &EndpointMessagePayloadInputPUSH{}
+	case EndpointMessageTypeLogPUSH:
+		return &EndpointMessagePayloadLogPUSH{}
 	}
-
-	type tmp EndpointMessage // avoids infinite recursion
-	return json.Unmarshal(data, (*tmp)(m))
+	return nil
 }
 
 type EndpointMessageType int
@@ -71,12 +100,59 @@ const (
 	EndpointMessageTypeDebugChangeRES = iota
 	EndpointMessageTypeDebugStepREQ   = iota
 	EndpointMessageTypeDebugStepRES   = iota
+	EndpointMessageTypePING           = iota
+	EndpointMessageTypePONG           = iota
+	EndpointMessageTypeSyncREQ        = iota
+	EndpointMessageTypeSyncRES        = iota
+	EndpointMessageTypeERROR          = iota
+	EndpointMessageTypeCHALLENGE      = iota
+	EndpointMessageTypeAUTH           = iota
+	EndpointMessageTypeMemoryPUSH     = iota
+	EndpointMessageTypeRulePUSH       = iota
+	EndpointMessageTypeInputPUSH      = iota
+	EndpointMessageTypeLogPUSH        = iota
 )
 
-type EndpointMessagePayloadACK struct{}
+// ResponseType returns the type of the response to a request of the specified type
+func ResponseType(t EndpointMessageType) EndpointMessageType {
+	switch t {
+	case EndpointMessageTypeMemoryREQ:
+		return EndpointMessageTypeMemoryRES
+	case EndpointMessageTypeInputREQ:
+		return EndpointMessageTypeInputRES
+	case EndpointMessageTypeConfigREQ:
+		return EndpointMessageTypeConfigRES
+	case EndpointMessageTypeDebugREQ:
+		return EndpointMessageTypeDebugRES
+	case EndpointMessageTypeDebugChangeREQ:
+		return EndpointMessageTypeDebugChangeRES
+	case EndpointMessageTypeDebugStepREQ:
+		return EndpointMessageTypeDebugStepRES
+	case EndpointMessageTypePING:
+		return EndpointMessageTypePONG
+	case EndpointMessageTypeSyncREQ:
+		return EndpointMessageTypeSyncRES
+	}
+	return -1
+}
+
+type EndpointMessagePayloadACK struct {
+	Reason       EndpointAckReason `json:"reason"`
+	Message      string            `json:"message"`
+	Name         string            `json:"name"`
+	Version      int               `json:"version"`
+	Capabilities []string          `json:"capabilities"`
+	Codec        string            `json:"codec"`
+	Compression  string            `json:"compression"`
+}
 
 type EndpointMessagePayloadINIT struct {
-	Name string `json:"name"`
+	Name         string            `json:"name"`
+	Version      int               `json:"version"`
+	Capabilities []string          `json:"capabilities"`
+	Codecs       []string          `json:"codecs"`
+	Compressions []string          `json:"compressions"`
+	Labels       map[string]string `json:"labels,omitempty"`
 }
 
 type EndpointMessagePayloadMemoryREQ struct{}
@@ -112,6 +188,57 @@ type EndpointMessagePayloadDebugChangeRES struct{}
 type EndpointMessagePayloadDebugStepREQ struct{}
 type EndpointMessagePayloadDebugStepRES struct{}
 
+type EndpointMessagePayloadPING struct{}
+type EndpointMessagePayloadPONG struct{}
+
+type EndpointMessagePayloadSyncREQ struct {
+	Token string `json:"token"`
+}
+type EndpointMessagePayloadSyncRES struct {
+	Token string `json:"token"`
+}
+
+type EndpointMessagePayloadERROR struct {
+	Code    string              `json:"code"`
+	Message string              `json:"message"`
+	Request EndpointMessageType `json:"request"`
+}
+
+type EndpointMessagePayloadCHALLENGE struct {
+	Nonce []byte `json:"nonce"`
+}
+
+type EndpointMessagePayloadAUTH struct {
+	MAC []byte `json:"mac"`
+}
+
+// EndpointMessagePayloadMemoryPUSH contains the resources whose value changed
+type EndpointMessagePayloadMemoryPUSH struct {
+	Time    time.Time       `json:"time"`
+	Changes MemoryResources `json:"changes"`
+}
+
+// EndpointMessagePayloadRulePUSH contains a rule fired and the actions it
+// added to the pool
+type EndpointMessagePayloadRulePUSH struct {
+	Time    time.Time  `json:"time"`
+	Rule    string     `json:"rule"`
+	Actions []PoolElem `json:"actions"`
+}
+
+// EndpointMessagePayloadInputPUSH contains an input applied to the memory
+type EndpointMessagePayloadInputPUSH struct {
+	Time  time.Time `json:"time"`
+	Input string    `json:"input"`
+}
+
+// EndpointMessagePayloadLogPUSH contains a log line of the agent
+type EndpointMessagePayloadLogPUSH struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
 // MemoryResources represents the resources of an agent
 type MemoryResources struct {
 	Bool    map[string]bool      `json:"bool"`
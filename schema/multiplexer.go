@@ -0,0 +1,412 @@
+package schema
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrMultiplexerClosed is returned for the requests on a closed multiplexer
+var ErrMultiplexerClosed = errors.New("multiplexer closed")
+
+// ErrDesynced is returned for the requests on a desynchronized connection
+var ErrDesynced = errors.New("connection desynchronized")
+
+// ResyncTimeout is the maximum duration of a resynchronization, after which
+// the connection is closed
+const ResyncTimeout = 5 * time.Second
+
+// PushBufferSize is the number of push messages that a subscriber can
+// leave unread before the next ones are dropped
+const PushBufferSize = 64
+
+// pushSubscriber represents a subscriber to the push messages
+type pushSubscriber struct {
+	types []EndpointMessageType
+	ch    chan *EndpointMessage
+}
+
+// pendingRequest represents a request waiting for its response
+type pendingRequest struct {
+	expected EndpointMessageType
+	ch       chan *EndpointMessage
+}
+
+// Multiplexer allows several requests to be outstanding on the same endpoint,
+// routing every response to its request by means of the message ID
+type Multiplexer struct {
+	end       *Endpoint
+	lock      sync.Mutex
+	nextID    uint64
+	pending   map[uint64]*pendingRequest
+	abandoned map[uint64]struct{}
+	done      chan struct{}
+	err       error
+	lastRx    time.Time
+	// lastRoundTrip is the time of the last successful response, which
+	// took roundTrip
+	lastRoundTrip time.Time
+	roundTrip     time.Duration
+	// desynced is true while the multiplexer waits for the answer to a
+	// resynchronization request with the token syncToken
+	desynced  bool
+	desyncs   int
+	syncToken string
+	synced    chan struct{}
+	// subscribers receive the push messages, without ever blocking the
+	// responses: the messages they cannot accept are dropped
+	subscribers map[*pushSubscriber]struct{}
+	dropped     int
+}
+
+// NewMultiplexer creates a new multiplexer over an endpoint and starts
+// receiving its messages
+func NewMultiplexer(end *Endpoint) *Multiplexer {
+	// I create the multiplexer...
+	m := &Multiplexer{
+		end:       end,
+		pending:   make(map[uint64]*pendingRequest),
+		abandoned: make(map[uint64]struct{}),
+		done:      make(chan struct{}),
+
+		subscribers: make(map[*pushSubscriber]struct{}),
+	}
+	// ... I start receiving the responses...
+	go m.receive()
+	// ... and I return it
+	return m
+}
+
+// Request sends a request and waits for its response, until the context is
+// done; if the agent answers with an ERROR message, it returns an AgentError
+func (m *Multiplexer) Request(ctx context.Context, msg *EndpointMessage) (*EndpointMessage, error) {
+	// I reserve an ID and a channel for the response...
+	m.lock.Lock()
+	if m.err != nil {
+		m.lock.Unlock()
+		return nil, m.err
+	}
+	if m.desynced {
+		m.lock.Unlock()
+		return nil, fmt.Errorf("%w: resynchronization in progress", ErrDesynced)
+	}
+	m.nextID++
+	id := m.nextID
+	p := &pendingRequest{
+		expected: ResponseType(msg.Type),
+		ch:       make(chan *EndpointMessage, 1),
+	}
+	m.pending[id] = p
+	m.lock.Unlock()
+	// ... I send the request with the reserved ID...
+	req := *msg
+	req.ID = id
+	start := time.Now()
+	err := m.end.WriteContext(ctx, &req)
+	if recoverable(err) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		// The request could not be framed or the context was done before
+		// writing it, so nothing was sent
+		m.lock.Lock()
+		delete(m.pending, id)
+		m.lock.Unlock()
+		return nil, err
+	}
+	if err != nil {
+		// A failed write could leave a partial message on the connection,
+		// so I cannot use it anymore
+		m.fail(err)
+		return nil, err
+	}
+	// ... and I wait for the response
+	select {
+	case res, ok := <-p.ch:
+		if !ok {
+			return nil, fmt.Errorf("%w: unexpected message while waiting for the response", ErrDesynced)
+		}
+		// If the agent answered with an error, I return it...
+		if payload, ok := res.Payload.(*EndpointMessagePayloadERROR); ok && res.Type == EndpointMessageTypeERROR {
+			return nil, &AgentError{
+				Code:    payload.Code,
+				Message: payload.Message,
+				Request: payload.Request,
+			}
+		}
+		// ... otherwise I record the successful round trip
+		m.lock.Lock()
+		m.lastRoundTrip = time.Now()
+		m.roundTrip = m.lastRoundTrip.Sub(start)
+		m.lock.Unlock()
+		return res, nil
+	case <-m.done:
+		return nil, m.Err()
+	case <-ctx.Done():
+		m.abandon(id)
+		return nil, ctx.Err()
+	}
+}
+
+// Endpoint returns the endpoint of the multiplexer
+func (m *Multiplexer) Endpoint() *Endpoint {
+	return m.end
+}
+
+// Done returns a channel that is closed when the multiplexer stops receiving
+func (m *Multiplexer) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns the reason why the multiplexer stopped receiving, if it did
+func (m *Multiplexer) Err() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.err
+}
+
+// LastReceived returns the time of the last message received, if any
+func (m *Multiplexer) LastReceived() time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.lastRx
+}
+
+// LastRoundTrip returns the time of the last successful response to a
+// request, if any, and how long the request waited for it
+func (m *Multiplexer) LastRoundTrip() (time.Time, time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.lastRoundTrip, m.roundTrip
+}
+
+// Desynced returns whether the multiplexer is resynchronizing the connection
+func (m *Multiplexer) Desynced() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.desynced
+}
+
+// Desyncs returns how many times the connection was desynchronized
+func (m *Multiplexer) Desyncs() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.desyncs
+}
+
+// Subscribe returns a channel receiving the push messages of the specified
+// types, or of all types if none is specified, and a function to cancel
+// the subscription; the channel is closed when the multiplexer stops
+func (m *Multiplexer) Subscribe(types ...EndpointMessageType) (<-chan *EndpointMessage, func()) {
+	// I create the subscriber...
+	s := &pushSubscriber{
+		types: types,
+		ch:    make(chan *EndpointMessage, PushBufferSize),
+	}
+	// ... I add it, unless the multiplexer already stopped...
+	m.lock.Lock()
+	if m.err != nil {
+		close(s.ch)
+	} else {
+		m.subscribers[s] = struct{}{}
+	}
+	m.lock.Unlock()
+	// ... and I return its channel with the cancel function
+	cancel := func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if _, ok := m.subscribers[s]; ok {
+			delete(m.subscribers, s)
+			close(s.ch)
+		}
+	}
+	return s.ch, cancel
+}
+
+// DroppedPushes returns how many push messages were dropped because a
+// subscriber was not reading them
+func (m *Multiplexer) DroppedPushes() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.dropped
+}
+
+// Close closes the multiplexer and its endpoint
+func (m *Multiplexer) Close() {
+	m.fail(ErrMultiplexerClosed)
+}
+
+// receive routes the incoming responses to the pending requests
+func (m *Multiplexer) receive() {
+	// Forever...
+	for {
+		// ... I read a message...
+		msg, err := m.end.Read()
+		if err != nil && !recoverable(err) {
+			m.stop(err)
+			return
+		}
+		m.lock.Lock()
+		m.lastRx = time.Now()
+		// ... if it cannot be decoded, I cannot tell which request it
+		// answers, so the connection is out of sync...
+		if err != nil {
+			if !m.desynced {
+				m.desync()
+			}
+			m.lock.Unlock()
+			continue
+		}
+		// ... if it is a push message, I route it to the subscribers, since
+		// it does not answer any request...
+		if IsPushType(msg.Type) {
+			m.publish(msg)
+			m.lock.Unlock()
+			continue
+		}
+		// ... if I am resynchronizing, I discard everything until the
+		// answer to the resynchronization request...
+		if m.desynced {
+			if payload, ok := msg.Payload.(*EndpointMessagePayloadSyncRES); ok && msg.Type == EndpointMessageTypeSyncRES && payload.Token == m.syncToken {
+				m.desynced = false
+				m.abandoned = make(map[uint64]struct{})
+				close(m.synced)
+			}
+			m.lock.Unlock()
+			continue
+		}
+		// ... otherwise I look for the request it answers...
+		p, ok := m.pending[msg.ID]
+		delete(m.pending, msg.ID)
+		_, late := m.abandoned[msg.ID]
+		delete(m.abandoned, msg.ID)
+		// ... and I check what to do with it
+		switch {
+		// If it is the expected response, I deliver it...
+		case ok && (msg.Type == p.expected || msg.Type == EndpointMessageTypeERROR):
+			m.lock.Unlock()
+			p.ch <- msg
+		// ... if it is a late response, I drop it...
+		case late:
+			m.lock.Unlock()
+		// ... otherwise the connection is out of sync
+		default:
+			if ok {
+				close(p.ch)
+			}
+			m.desync()
+			m.lock.Unlock()
+		}
+	}
+}
+
+// publish delivers a push message to the interested subscribers, it must
+// be called holding the lock
+func (m *Multiplexer) publish(msg *EndpointMessage) {
+	for s := range m.subscribers {
+		if len(s.types) > 0 && !hasType(s.types, msg.Type) {
+			continue
+		}
+		select {
+		case s.ch <- msg:
+		default:
+			m.dropped++
+		}
+	}
+}
+
+// hasType checks whether a message type is in a list
+func hasType(types []EndpointMessageType, t EndpointMessageType) bool {
+	for _, typ := range types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+// abandon removes a pending request whose response is no longer awaited
+func (m *Multiplexer) abandon(id uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.pending[id]; ok {
+		delete(m.pending, id)
+		m.abandoned[id] = struct{}{}
+	}
+}
+
+// desync fails all the pending requests and starts a resynchronization,
+// it must be called holding the lock
+func (m *Multiplexer) desync() {
+	// I fail the pending requests...
+	for _, p := range m.pending {
+		close(p.ch)
+	}
+	m.pending = make(map[uint64]*pendingRequest)
+	// ... I generate a new token...
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		go m.fail(err)
+		return
+	}
+	// ... and I start the resynchronization
+	m.desynced = true
+	m.desyncs++
+	m.syncToken = hex.EncodeToString(b)
+	m.synced = make(chan struct{})
+	go m.resync(m.syncToken, m.synced)
+}
+
+// resync asks the agent to resynchronize, closing the connection if the
+// agent does not support it or if it does not answer in time
+func (m *Multiplexer) resync(token string, synced chan struct{}) {
+	// I check whether the agent supports the resynchronization...
+	if !m.end.HasCapability(CapabilityResync) {
+		m.fail(ErrDesynced)
+		return
+	}
+	// ... I send the resynchronization request...
+	ctx, cancel := context.WithTimeout(context.Background(), ResyncTimeout)
+	defer cancel()
+	err := m.end.WriteContext(ctx, &EndpointMessage{
+		Type: EndpointMessageTypeSyncREQ,
+		Payload: &EndpointMessagePayloadSyncREQ{
+			Token: token,
+		},
+	})
+	if err != nil {
+		m.fail(err)
+		return
+	}
+	// ... and I wait for the answer
+	select {
+	case <-synced:
+	case <-m.done:
+	case <-ctx.Done():
+		m.fail(fmt.Errorf("%w: no answer to the resynchronization", ErrDesynced))
+	}
+}
+
+// fail stops the multiplexer and closes its endpoint
+func (m *Multiplexer) fail(err error) {
+	m.stop(err)
+	m.end.Close()
+}
+
+// stop stops the multiplexer, failing all the pending requests
+func (m *Multiplexer) stop(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	m.pending = make(map[uint64]*pendingRequest)
+	for s := range m.subscribers {
+		close(s.ch)
+	}
+	m.subscribers = make(map[*pushSubscriber]struct{})
+	close(m.done)
+}
@@ -0,0 +1,419 @@
+package schema
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// muxPair returns a multiplexer with the specified capabilities and the
+// endpoint of the agent it talks to, with its raw connection
+func muxPair(t *testing.T, capabilities ...string) (*Multiplexer, *Endpoint, net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	coordinator := New(a)
+	coordinator.SetCapabilities(capabilities)
+	m := NewMultiplexer(coordinator)
+	t.Cleanup(func() {
+		m.Close()
+		b.Close()
+	})
+	return m, New(b), b
+}
+
+// result represents the outcome of a request
+type result struct {
+	msg *EndpointMessage
+	err error
+}
+
+// requestAsync sends a request on the multiplexer without waiting for the
+// response
+func requestAsync(ctx context.Context, m *Multiplexer, msg *EndpointMessage) <-chan result {
+	ch := make(chan result, 1)
+	go func() {
+		res, err := m.Request(ctx, msg)
+		ch <- result{res, err}
+	}()
+	return ch
+}
+
+// inputRequest returns an input request with the specified input
+func inputRequest(input string) *EndpointMessage {
+	return &EndpointMessage{
+		Type:    EndpointMessageTypeInputREQ,
+		Payload: &EndpointMessagePayloadInputREQ{Input: input},
+	}
+}
+
+// inputResponse returns the response to an input request, echoing its input
+// as the error so that the responses can be told apart
+func inputResponse(req *EndpointMessage) *EndpointMessage {
+	return &EndpointMessage{
+		ID:   req.ID,
+		Type: EndpointMessageTypeInputRES,
+		Payload: &EndpointMessagePayloadInputRES{
+			Error: req.Payload.(*EndpointMessagePayloadInputREQ).Input,
+		},
+	}
+}
+
+// readRequest reads a request on the agent endpoint, failing the test if
+// it does not arrive
+func readRequest(t *testing.T, agent *Endpoint, expected EndpointMessageType) *EndpointMessage {
+	t.Helper()
+	msg, err := agent.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != expected {
+		t.Fatalf("expected a message of type %d, got %d", expected, msg.Type)
+	}
+	return msg
+}
+
+// echoed returns the input echoed by an input response
+func echoed(t *testing.T, r result) string {
+	t.Helper()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return r.msg.Payload.(*EndpointMessagePayloadInputRES).Error
+}
+
+func TestMultiplexerRoutesResponses(t *testing.T) {
+	m, agent, _ := muxPair(t)
+	// I send some requests at the same time...
+	const n = 5
+	results := []<-chan result{}
+	for i := 0; i < n; i++ {
+		results = append(results, requestAsync(context.Background(), m, inputRequest(strconv.Itoa(i))))
+	}
+	// ... I read them, checking that they have different IDs...
+	reqs := []*EndpointMessage{}
+	ids := map[uint64]bool{}
+	for i := 0; i < n; i++ {
+		req := readRequest(t, agent, EndpointMessageTypeInputREQ)
+		if req.ID == 0 || ids[req.ID] {
+			t.Fatalf("expected a new request ID, got %d", req.ID)
+		}
+		ids[req.ID] = true
+		reqs = append(reqs, req)
+	}
+	// ... I answer them in reverse order...
+	sort.Slice(reqs, func(i, j int) bool {
+		return reqs[i].ID > reqs[j].ID
+	})
+	for _, req := range reqs {
+		if err := agent.Write(inputResponse(req)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// ... and every request gets its own response
+	for i, ch := range results {
+		if got := echoed(t, <-ch); got != strconv.Itoa(i) {
+			t.Fatalf("request %d got the response of request %s", i, got)
+		}
+	}
+	if m.Desyncs() != 0 {
+		t.Fatalf("expected no desynchronizations, got %d", m.Desyncs())
+	}
+}
+
+func TestMultiplexerAgentError(t *testing.T) {
+	m, agent, _ := muxPair(t)
+	ch := requestAsync(context.Background(), m, inputRequest("x"))
+	req := readRequest(t, agent, EndpointMessageTypeInputREQ)
+	err := agent.Write(&EndpointMessage{
+		ID:   req.ID,
+		Type: EndpointMessageTypeERROR,
+		Payload: &EndpointMessagePayloadERROR{
+			Code:    EndpointErrorRejected,
+			Message: "no",
+			Request: EndpointMessageTypeInputREQ,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-ch
+	agentErr := &AgentError{}
+	if !errors.As(r.err, &agentErr) || agentErr.Code != EndpointErrorRejected || agentErr.Message != "no" {
+		t.Fatalf("expected an agent error, got %v", r.err)
+	}
+	// An error is not a successful round trip...
+	if last, _ := m.LastRoundTrip(); !last.IsZero() {
+		t.Fatalf("expected no round trip, got %v", last)
+	}
+	// ... while a response is
+	ch = requestAsync(context.Background(), m, inputRequest("y"))
+	req = readRequest(t, agent, EndpointMessageTypeInputREQ)
+	if err := agent.Write(inputResponse(req)); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-ch; r.err != nil {
+		t.Fatal(r.err)
+	}
+	if last, _ := m.LastRoundTrip(); last.IsZero() {
+		t.Fatal("expected the round trip to be recorded")
+	}
+}
+
+func TestMultiplexerTimeout(t *testing.T) {
+	m, agent, _ := muxPair(t)
+	// A request that is not answered in time fails with the context...
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ch := requestAsync(ctx, m, inputRequest("slow"))
+	readRequest(t, agent, EndpointMessageTypeInputREQ)
+	if r := <-ch; !errors.Is(r.err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", r.err)
+	}
+	// ... and so does a cancelled one, without affecting the connection
+	ctx, cancel = context.WithCancel(context.Background())
+	ch = requestAsync(ctx, m, inputRequest("cancelled"))
+	readRequest(t, agent, EndpointMessageTypeInputREQ)
+	cancel()
+	if r := <-ch; !errors.Is(r.err, context.Canceled) {
+		t.Fatalf("expected a cancellation error, got %v", r.err)
+	}
+	if m.Desynced() {
+		t.Fatal("expected the connection to be in sync")
+	}
+}
+
+func TestMultiplexerClosed(t *testing.T) {
+	m, agent, _ := muxPair(t)
+	ch := requestAsync(context.Background(), m, inputRequest("x"))
+	readRequest(t, agent, EndpointMessageTypeInputREQ)
+	// Closing the agent connection fails the pending requests...
+	agent.Close()
+	if r := <-ch; r.err == nil {
+		t.Fatal("expected the pending request to fail")
+	}
+	<-m.Done()
+	// ... and the next ones
+	if _, err := m.Request(context.Background(), inputRequest("y")); err == nil {
+		t.Fatal("expected the request to fail")
+	}
+}
+
+func TestMultiplexerLateReply(t *testing.T) {
+	m, agent, _ := muxPair(t, CapabilityResync)
+	// I abandon a request...
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ch := requestAsync(ctx, m, inputRequest("late"))
+	late := readRequest(t, agent, EndpointMessageTypeInputREQ)
+	if r := <-ch; !errors.Is(r.err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", r.err)
+	}
+	// ... I send the next one, and the agent answers both in order...
+	ch = requestAsync(context.Background(), m, inputRequest("next"))
+	next := readRequest(t, agent, EndpointMessageTypeInputREQ)
+	for _, req := range []*EndpointMessage{late, next} {
+		if err := agent.Write(inputResponse(req)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// ... so the late response is dropped without desynchronizing
+	if got := echoed(t, <-ch); got != "next" {
+		t.Fatalf("expected the response to the next request, got %s", got)
+	}
+	if m.Desyncs() != 0 {
+		t.Fatalf("expected no desynchronizations, got %d", m.Desyncs())
+	}
+}
+
+// resync answers the resynchronization request of the multiplexer, after
+// sending a stale message that the multiplexer must discard
+func resync(t *testing.T, agent *Endpoint) {
+	t.Helper()
+	req := readRequest(t, agent, EndpointMessageTypeSyncREQ)
+	token := req.Payload.(*EndpointMessagePayloadSyncREQ).Token
+	msgs := []*EndpointMessage{
+		{ID: 1000, Type: EndpointMessageTypeInputRES, Payload: &EndpointMessagePayloadInputRES{}},
+		{ID: req.ID, Type: EndpointMessageTypeSyncRES, Payload: &EndpointMessagePayloadSyncRES{Token: "stale"}},
+		{ID: req.ID, Type: EndpointMessageTypeSyncRES, Payload: &EndpointMessagePayloadSyncRES{Token: token}},
+	}
+	for _, msg := range msgs {
+		if err := agent.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitSynced waits until the multiplexer is in sync again
+func waitSynced(t *testing.T, m *Multiplexer) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for m.Desynced() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the connection to be resynchronized")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMultiplexerResync(t *testing.T) {
+	tests := []struct {
+		name string
+		// desync makes the agent desynchronize the connection, while the
+		// request is pending
+		desync func(t *testing.T, agent *Endpoint, conn net.Conn, req *EndpointMessage)
+	}{
+		{"unknown ID", func(t *testing.T, agent *Endpoint, conn net.Conn, req *EndpointMessage) {
+			msg := inputResponse(req)
+			msg.ID = req.ID + 100
+			if err := agent.Write(msg); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"unexpected type", func(t *testing.T, agent *Endpoint, conn net.Conn, req *EndpointMessage) {
+			err := agent.Write(&EndpointMessage{ID: req.ID, Type: EndpointMessageTypeDebugRES, Payload: &EndpointMessagePayloadDebugRES{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"undecodable message", func(t *testing.T, agent *Endpoint, conn net.Conn, req *EndpointMessage) {
+			if _, err := conn.Write(frame(FrameMagic, FrameVersion, 0, 3, []byte("{{{"))); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, agent, conn := muxPair(t, CapabilityResync)
+			// I desynchronize the connection while a request is pending...
+			ch := requestAsync(context.Background(), m, inputRequest("pending"))
+			req := readRequest(t, agent, EndpointMessageTypeInputREQ)
+			test.desync(t, agent, conn, req)
+			// ... so the request fails...
+			if r := <-ch; !errors.Is(r.err, ErrDesynced) {
+				t.Fatalf("expected a desynchronization error, got %v", r.err)
+			}
+			if !m.Desynced() || m.Desyncs() != 1 {
+				t.Fatalf("expected one desynchronization, got %v, %d", m.Desynced(), m.Desyncs())
+			}
+			// ... and so do the new ones, until the resynchronization...
+			if _, err := m.Request(context.Background(), inputRequest("refused")); !errors.Is(err, ErrDesynced) {
+				t.Fatalf("expected a desynchronization error, got %v", err)
+			}
+			resync(t, agent)
+			waitSynced(t, m)
+			// ... after which the requests work again
+			ch = requestAsync(context.Background(), m, inputRequest("after"))
+			req = readRequest(t, agent, EndpointMessageTypeInputREQ)
+			if err := agent.Write(inputResponse(req)); err != nil {
+				t.Fatal(err)
+			}
+			if got := echoed(t, <-ch); got != "after" {
+				t.Fatalf("expected the response to the new request, got %s", got)
+			}
+		})
+	}
+}
+
+func TestMultiplexerDesyncWithoutResync(t *testing.T) {
+	m, agent, _ := muxPair(t)
+	// An agent without the resync capability desynchronizes the connection...
+	ch := requestAsync(context.Background(), m, inputRequest("pending"))
+	req := readRequest(t, agent, EndpointMessageTypeInputREQ)
+	msg := inputResponse(req)
+	msg.ID = req.ID + 100
+	if err := agent.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-ch; !errors.Is(r.err, ErrDesynced) {
+		t.Fatalf("expected a desynchronization error, got %v", r.err)
+	}
+	// ... so the connection is closed
+	select {
+	case <-m.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the multiplexer to stop")
+	}
+	if !errors.Is(m.Err(), ErrDesynced) {
+		t.Fatalf("expected a desynchronization error, got %v", m.Err())
+	}
+}
+
+func TestMultiplexerPushes(t *testing.T) {
+	m, agent, _ := muxPair(t)
+	logs, cancel := m.Subscribe(EndpointMessageTypeLogPUSH)
+	defer cancel()
+	// The push messages reach the subscribers while a request is pending...
+	ch := requestAsync(context.Background(), m, inputRequest("x"))
+	req := readRequest(t, agent, EndpointMessageTypeInputREQ)
+	pushes := []*EndpointMessage{
+		{Type: EndpointMessageTypeMemoryPUSH, Payload: &EndpointMessagePayloadMemoryPUSH{}},
+		{Type: EndpointMessageTypeLogPUSH, Payload: &EndpointMessagePayloadLogPUSH{Message: "hello"}},
+		inputResponse(req),
+	}
+	for _, msg := range pushes {
+		if err := agent.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// ... without affecting the response
+	if got := echoed(t, <-ch); got != "x" {
+		t.Fatalf("expected the response to the request, got %s", got)
+	}
+	select {
+	case msg := <-logs:
+		if msg.Payload.(*EndpointMessagePayloadLogPUSH).Message != "hello" {
+			t.Fatalf("unexpected push message %+v", msg.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the log push message")
+	}
+	if m.Desyncs() != 0 {
+		t.Fatalf("expected no desynchronizations, got %d", m.Desyncs())
+	}
+}
+
+func TestMultiplexerUnsentRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+	}{
+		{"expired context", func() (context.Context, context.CancelFunc) {
+			return context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		}},
+		{"cancelled context", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, cancel
+		}},
+		// The agent does not read, so the deadline expires before writing
+		{"deadline while writing", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, agent, _ := muxPair(t)
+			// A request that cannot be written in time fails with the
+			// context...
+			ctx, cancel := test.ctx()
+			defer cancel()
+			_, err := m.Request(ctx, inputRequest("unsent"))
+			if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected an error of the context, got %v", err)
+			}
+			// ... without closing the connection, so the next one works
+			ch := requestAsync(context.Background(), m, inputRequest("next"))
+			req := readRequest(t, agent, EndpointMessageTypeInputREQ)
+			if err := agent.Write(inputResponse(req)); err != nil {
+				t.Fatal(err)
+			}
+			if got := echoed(t, <-ch); got != "next" {
+				t.Fatalf("expected the response to the next request, got %s", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package schema
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// pipeListeners contains the pipe listeners of the process by name
+var (
+	pipeLock      sync.Mutex
+	pipeListeners = map[string]*PipeListener{}
+)
+
+// pipeAddr represents the address of a pipe listener
+type pipeAddr string
+
+// Network returns the name of the network
+func (a pipeAddr) Network() string {
+	return TransportPipe
+}
+
+// String returns the name of the pipe listener
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+// PipeListener is a listener whose connections are in-memory pipes, so
+// that agents in the same process can connect without a network
+type PipeListener struct {
+	name  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// ListenPipe creates a pipe listener with the specified name, which the
+// agents of the same process can dial with the address pipe://name
+func ListenPipe(name string) (*PipeListener, error) {
+	pipeLock.Lock()
+	defer pipeLock.Unlock()
+	// I check that the name is free...
+	if _, ok := pipeListeners[name]; ok {
+		return nil, fmt.Errorf("pipe \"%s\" already in use", name)
+	}
+	// ... and I create the listener
+	l := &PipeListener{
+		name:  name,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	pipeListeners[name] = l
+	return l, nil
+}
+
+// DialPipe connects to the pipe listener with the specified name
+func DialPipe(name string) (net.Conn, error) {
+	// I look for the listener...
+	pipeLock.Lock()
+	l, ok := pipeListeners[name]
+	pipeLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no pipe \"%s\"", name)
+	}
+	// ... and I give it one side of a new pipe
+	return l.Dial()
+}
+
+// Dial creates a pipe, returning one side and passing the other one to Accept
+func (l *PipeListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		client.Close()
+		server.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+// Accept waits for a connection
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener, making its name available again
+func (l *PipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		pipeLock.Lock()
+		delete(pipeListeners, l.name)
+		pipeLock.Unlock()
+	})
+	return nil
+}
+
+// Addr returns the address of the listener
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
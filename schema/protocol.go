@@ -0,0 +1,128 @@
+package schema
+
+import "fmt"
+
+// ProtocolVersion is the version of the endpoint protocol implemented by
+// this package, agents and coordinator must agree on it
+const ProtocolVersion = 1
+
+const (
+	// CapabilityRequestID means that the responses echo the ID of the requests
+	CapabilityRequestID = "request-id"
+	// CapabilityHeartbeat means that the agent answers the PING requests
+	CapabilityHeartbeat = "heartbeat"
+	// CapabilityResync means that the agent answers the resynchronization requests
+	CapabilityResync = "resync"
+	// CapabilityError means that the agent can answer any request with an ERROR message
+	CapabilityError = "error"
+	// CapabilityPush means that the agent sends push messages, including
+	// every change of its memory
+	CapabilityPush = "push"
+)
+
+// SupportedCapabilities lists the capabilities implemented by this package
+var SupportedCapabilities = []string{
+	CapabilityRequestID,
+	CapabilityHeartbeat,
+	CapabilityResync,
+	CapabilityError,
+	CapabilityPush,
+}
+
+// RequiredCapabilities lists the capabilities that an agent must support
+// to be accepted by the coordinator
+var RequiredCapabilities = []string{
+	CapabilityRequestID,
+}
+
+// EndpointAckReason represents the reason of the acceptance or rejection of an agent
+type EndpointAckReason int
+
+const (
+	EndpointAckReasonAccepted          EndpointAckReason = iota
+	EndpointAckReasonInvalidInit       EndpointAckReason = iota
+	EndpointAckReasonVersionMismatch   EndpointAckReason = iota
+	EndpointAckReasonMissingCapability EndpointAckReason = iota
+	EndpointAckReasonNameTaken         EndpointAckReason = iota
+	EndpointAckReasonIdentityMismatch  EndpointAckReason = iota
+	EndpointAckReasonAuthFailed        EndpointAckReason = iota
+)
+
+// String returns a description of the reason
+func (r EndpointAckReason) String() string {
+	switch r {
+	case EndpointAckReasonAccepted:
+		return "accepted"
+	case EndpointAckReasonInvalidInit:
+		return "invalid initialization"
+	case EndpointAckReasonVersionMismatch:
+		return "protocol version mismatch"
+	case EndpointAckReasonMissingCapability:
+		return "missing capability"
+	case EndpointAckReasonNameTaken:
+		return "name taken"
+	case EndpointAckReasonIdentityMismatch:
+		return "identity mismatch"
+	case EndpointAckReasonAuthFailed:
+		return "authentication failed"
+	}
+	return fmt.Sprintf("unknown reason %d", int(r))
+}
+
+// HandshakeError is returned when the coordinator rejects an agent
+type HandshakeError struct {
+	Reason  EndpointAckReason
+	Message string
+}
+
+// Error returns the error description
+func (e *HandshakeError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("agent rejected: %s", e.Reason)
+	}
+	return fmt.Sprintf("agent rejected: %s: %s", e.Reason, e.Message)
+}
+
+// NegotiateCapabilities returns the offered capabilities that are supported
+func NegotiateCapabilities(offered []string) []string {
+	negotiated := []string{}
+	for _, c := range offered {
+		if HasCapability(SupportedCapabilities, c) && !HasCapability(negotiated, c) {
+			negotiated = append(negotiated, c)
+		}
+	}
+	return negotiated
+}
+
+// HasCapability checks whether a capability is in a list of capabilities
+func HasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// EndpointErrorUnsupported means that the agent does not support the request
+	EndpointErrorUnsupported = "unsupported"
+	// EndpointErrorInvalidPayload means that the request payload is not valid
+	EndpointErrorInvalidPayload = "invalid_payload"
+	// EndpointErrorRejected means that the agent refused to execute the request
+	EndpointErrorRejected = "rejected"
+	// EndpointErrorInternal means that the agent failed executing the request
+	EndpointErrorInternal = "internal"
+)
+
+// AgentError represents an error answered by an agent with an ERROR message
+type AgentError struct {
+	Code    string
+	Message string
+	Request EndpointMessageType
+}
+
+// Error returns the error description
+func (e *AgentError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
@@ -0,0 +1,37 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrPushUnsupported is returned when pushing on a connection that did not
+// negotiate the push messages
+var ErrPushUnsupported = errors.New("push messages not negotiated")
+
+// IsPushType checks whether a message type is a push message, which the
+// agent sends without a request and always with ID 0
+func IsPushType(t EndpointMessageType) bool {
+	switch t {
+	case EndpointMessageTypeMemoryPUSH, EndpointMessageTypeRulePUSH, EndpointMessageTypeInputPUSH, EndpointMessageTypeLogPUSH:
+		return true
+	}
+	return false
+}
+
+// Push sends a push message to the coordinator, it is safe to call it
+// while ServeAgent is answering the requests
+func Push(end *Endpoint, t EndpointMessageType, payload interface{}) error {
+	// I check that the message can be pushed...
+	if !IsPushType(t) {
+		return fmt.Errorf("message type %d is not a push message", t)
+	}
+	if !end.HasCapability(CapabilityPush) {
+		return ErrPushUnsupported
+	}
+	// ... and I send it
+	return end.Write(&EndpointMessage{
+		Type:    t,
+		Payload: payload,
+	})
+}
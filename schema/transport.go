@@ -0,0 +1,38 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The transports that can carry the frames, used as the schemes of the
+// addresses
+const (
+	// TransportTCP connects over TCP, the address is host:port
+	TransportTCP = "tcp"
+	// TransportUnix connects over a Unix domain socket, the address is a path
+	TransportUnix = "unix"
+	// TransportWebSocket connects over WebSocket, the address is host:port/path
+	TransportWebSocket = "ws"
+	// TransportWebSocketTLS connects over WebSocket with TLS, the address is host:port/path
+	TransportWebSocketTLS = "wss"
+	// TransportPipe connects in memory to a pipe listener of the same
+	// process, the address is the name of the listener
+	TransportPipe = "pipe"
+)
+
+// ParseAddress splits an address in the form transport://address in its
+// transport and address, an address without transport uses TCP
+func ParseAddress(addr string) (string, string, error) {
+	// I split the address...
+	parts := strings.SplitN(addr, "://", 2)
+	if len(parts) == 1 {
+		return TransportTCP, addr, nil
+	}
+	// ... and I check the transport
+	switch parts[0] {
+	case TransportTCP, TransportUnix, TransportWebSocket, TransportWebSocketTLS, TransportPipe:
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("unknown transport \"%s\"", parts[0])
+}
@@ -0,0 +1,111 @@
+package schema
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketConn adapts a WebSocket connection to a net.Conn, so that the
+// frames are carried as a byte stream inside binary WebSocket messages
+type WebSocketConn struct {
+	ws *websocket.Conn
+	// reader is the reader of the current message, nil if there is none
+	rlock  sync.Mutex
+	reader io.Reader
+	wlock  sync.Mutex
+}
+
+// NewWebSocketConn creates a net.Conn from a WebSocket connection
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	return &WebSocketConn{
+		ws: ws,
+	}
+}
+
+// Read reads from the binary messages, moving to the next message when
+// the current one is over
+func (c *WebSocketConn) Read(b []byte) (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	// Until I read something...
+	for {
+		// ... I get a message, if I do not have one...
+		if c.reader == nil {
+			t, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if t != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = r
+		}
+		// ... and I read from it, dropping it when it is over
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write writes the bytes as a binary message
+func (c *WebSocketConn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	err := c.ws.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the WebSocket connection
+func (c *WebSocketConn) Close() error {
+	return c.ws.Close()
+}
+
+// LocalAddr returns the local address of the connection
+func (c *WebSocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the connection
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+// SetDeadline sets both the read and the write deadlines
+func (c *WebSocketConn) SetDeadline(t time.Time) error {
+	err := c.ws.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// UnderlyingConn returns the connection carrying the WebSocket
+func (c *WebSocketConn) UnderlyingConn() net.Conn {
+	return c.ws.UnderlyingConn()
+}